@@ -0,0 +1,173 @@
+package deks
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/simia-tech/errx"
+)
+
+// Role defines a set of commands, a user is allowed to run.
+type Role string
+
+const (
+	// RoleClient allows the data commands. The access to the keys is limited by the user's ACLs.
+	RoleClient Role = "client"
+
+	// RolePeer allows the commands, that are used by other nodes for replication and membership.
+	RolePeer Role = "peer"
+
+	// RoleAdmin allows the management of peers and the maintenance of the store.
+	RoleAdmin Role = "admin"
+)
+
+// DefaultUser defines the name of the user, that is authenticated by an AUTH command with a
+// password only.
+const DefaultUser = "default"
+
+// ACL defines the access to all keys with the prefix.
+type ACL struct {
+	Prefix string `json:"prefix"`
+	Read   bool   `json:"read"`
+	Write  bool   `json:"write"`
+}
+
+// User defines a user, that can authenticate with the AUTH command.
+type User struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Roles    []Role `json:"roles"`
+
+	// ACLs defines the access of the client role to the keys. If multiple prefixes match a key,
+	// the longest one is used. Keys without a matching prefix can't be accessed. If no ACLs are
+	// defined, all keys can be read and written.
+	ACLs []ACL `json:"acls"`
+}
+
+// LoadUsers reads the users from the provided json file.
+func LoadUsers(path string) ([]User, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errx.Annotatef(err, "read [%s]", path)
+	}
+	users := []User{}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, errx.Annotatef(err, "unmarshal [%s]", path)
+	}
+	return users, nil
+}
+
+func (u *User) hasRole(role Role) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccess returns true, if the user is allowed to read or write the provided key.
+func (u *User) canAccess(key []byte, write bool) bool {
+	if !u.hasRole(RoleClient) {
+		return false
+	}
+	if len(u.ACLs) == 0 {
+		return true
+	}
+	var result *ACL
+	for index, acl := range u.ACLs {
+		if strings.HasPrefix(string(key), acl.Prefix) && (result == nil || len(acl.Prefix) > len(result.Prefix)) {
+			result = &u.ACLs[index]
+		}
+	}
+	if result == nil {
+		return false
+	}
+	if write {
+		return result.Write
+	}
+	return result.Read
+}
+
+// SetUsers sets the users, that can authenticate. If no users are set, the authentication is
+// disabled and all commands are allowed.
+func (s *Server) SetUsers(users []User) {
+	usersByName := make(map[string]*User, len(users))
+	for index := range users {
+		usersByName[users[index].Name] = &users[index]
+	}
+	s.usersMutex.Lock()
+	s.users = usersByName
+	s.usersMutex.Unlock()
+}
+
+// SetPeerCredentials sets the name and password, this node uses to authenticate at it's peers.
+func (s *Server) SetPeerCredentials(name, password string) {
+	s.usersMutex.Lock()
+	s.peerUser = name
+	s.peerPassword = password
+	s.usersMutex.Unlock()
+}
+
+func (s *Server) authEnabled() bool {
+	s.usersMutex.RLock()
+	defer s.usersMutex.RUnlock()
+	return len(s.users) > 0
+}
+
+func (s *Server) peerCredentials() (string, string) {
+	s.usersMutex.RLock()
+	defer s.usersMutex.RUnlock()
+	return s.peerUser, s.peerPassword
+}
+
+// authenticate returns the user with the provided name and password. If no user matches, nil
+// is returned.
+func (s *Server) authenticate(name, password string) *User {
+	s.usersMutex.RLock()
+	defer s.usersMutex.RUnlock()
+	user, ok := s.users[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return nil
+	}
+	return user
+}
+
+// authorize returns an error, if the provided user isn't allowed to run the command. If the
+// authentication is disabled, all commands are allowed.
+func (s *Server) authorize(user *User, command string, spec commandSpec, arguments [][]byte) error {
+	if spec.role == "" || !s.authEnabled() {
+		return nil
+	}
+	if user == nil {
+		return errNoAuth
+	}
+	if !user.hasRole(spec.role) {
+		return errNoPerm("this user has no permissions to run the '%s' command", command)
+	}
+	if spec.access == keyAccessNone {
+		return nil
+	}
+	for _, key := range spec.keys(arguments) {
+		if !user.canAccess(key, spec.access == keyAccessWrite) {
+			return errNoPerm("this user has no permissions to access the '%s' key", key)
+		}
+	}
+	return nil
+}
+
+// Auth authenticates the connection with the provided name and password. If the name is empty,
+// the DefaultUser is used.
+func (c *Conn) Auth(name, password string) error {
+	arguments := []interface{}{password}
+	if name != "" {
+		arguments = []interface{}{name, password}
+	}
+	response := c.client.Cmd(cmdAuth, arguments...)
+	if !isOK(response) {
+		return errx.Unauthorizedf("authentication failed")
+	}
+	return nil
+}
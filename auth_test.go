@@ -0,0 +1,91 @@
+package deks_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simia-tech/deks"
+)
+
+var testUsers = []deks.User{
+	{Name: "admin", Password: "admin-secret", Roles: []deks.Role{deks.RoleClient, deks.RoleAdmin}},
+	{Name: "peer", Password: "peer-secret", Roles: []deks.Role{deks.RolePeer}},
+	{Name: "reader", Password: "reader-secret", Roles: []deks.Role{deks.RoleClient}, ACLs: []deks.ACL{
+		{Prefix: "public/", Read: true},
+		{Prefix: "public/inbox/", Read: true, Write: true},
+	}},
+}
+
+func TestServerAuthRequired(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverOne.SetUsers(testUsers)
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.Ping())
+	assert.Error(t, conn.Set(testKey, testValue))
+	assert.Error(t, conn.Auth("admin", "wrong"))
+
+	require.NoError(t, conn.Auth("admin", "admin-secret"))
+	assert.NoError(t, conn.Set(testKey, testValue))
+	assert.NoError(t, conn.Tidy())
+}
+
+func TestServerAuthPrefixACLs(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverOne.SetUsers(testUsers)
+	require.NoError(t, e.storeOne.Set([]byte("public/one"), testValue))
+	require.NoError(t, e.storeOne.Set([]byte("private/one"), testValue))
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.Auth("reader", "reader-secret"))
+
+	value, err := conn.Get([]byte("public/one"))
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+
+	_, err = conn.Get([]byte("private/one"))
+	assert.Error(t, err)
+	assert.Error(t, conn.Set([]byte("public/one"), testValue))
+	assert.NoError(t, conn.Set([]byte("public/inbox/one"), testValue))
+
+	keys, err := conn.Keys()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, [][]byte{[]byte("public/one"), []byte("public/inbox/one")}, keys)
+
+	assert.Error(t, conn.Tidy())
+}
+
+func TestServerAuthPeerCredentials(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverTwo.SetUsers(testUsers)
+	require.NoError(t, e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, 20*time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, e.storeTwo.Len())
+
+	e.serverOne.SetPeerCredentials("peer", "peer-secret")
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	time.Sleep(50 * time.Millisecond)
+
+	value, err := e.storeTwo.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+}
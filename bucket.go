@@ -0,0 +1,46 @@
+package deks
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+)
+
+// bucket holds all containers whose keys share the same key hash. Usually, a bucket contains
+// exactly one container, but in case of a hash collision, the colliding keys are kept distinct
+// in the same bucket.
+type bucket []*container
+
+func (b bucket) find(key []byte) (int, *container) {
+	for index, c := range b {
+		if bytes.Equal(c.key, key) {
+			return index, c
+		}
+	}
+	return -1, nil
+}
+
+func (b bucket) remove(index int) bucket {
+	result := make(bucket, 0, len(b)-1)
+	result = append(result, b[:index]...)
+	return append(result, b[index+1:]...)
+}
+
+// revision returns the revision that represents the bucket in the state set. For a single
+// container, it's the container's revision. For multiple containers, it's an order-independent
+// digest of all keys and revisions, so two buckets are equal if all their containers are.
+func (b bucket) revision() uint64 {
+	if len(b) == 1 {
+		return b[0].revision
+	}
+	result := uint64(0)
+	buffer := make([]byte, 8)
+	for _, c := range b {
+		binary.BigEndian.PutUint64(buffer, c.revision)
+		hash := sha1.New()
+		hash.Write(c.key)
+		hash.Write(buffer)
+		result ^= binary.BigEndian.Uint64(hash.Sum(nil)[:8])
+	}
+	return result
+}
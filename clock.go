@@ -0,0 +1,79 @@
+package deks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	nodeIDSize = 8
+
+	timestampLogicalBits = 16
+	timestampLogicalMask = 1<<timestampLogicalBits - 1
+)
+
+type nodeID [nodeIDSize]byte
+
+func newNodeID() nodeID {
+	id := nodeID{}
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (id nodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// timestamp defines a hybrid logical clock timestamp. The upper 48 bits hold the physical time
+// in milliseconds, the lower 16 bits hold a logical counter.
+type timestamp uint64
+
+func newTimestamp(physical time.Time, logical uint64) timestamp {
+	return timestamp(uint64(physical.UnixNano()/int64(time.Millisecond))<<timestampLogicalBits | logical&timestampLogicalMask)
+}
+
+func (t timestamp) physical() uint64 {
+	return uint64(t) >> timestampLogicalBits
+}
+
+// Time returns the physical part of the timestamp.
+func (t timestamp) Time() time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(t.physical())*int64(time.Millisecond))
+}
+
+// clock implements a hybrid logical clock.
+type clock struct {
+	last  timestamp
+	mutex sync.Mutex
+}
+
+// now returns a timestamp for a local event.
+func (c *clock) now() timestamp {
+	pt := newTimestamp(time.Now(), 0)
+	c.mutex.Lock()
+	if pt > c.last {
+		c.last = pt
+	} else {
+		c.last++
+	}
+	result := c.last
+	c.mutex.Unlock()
+	return result
+}
+
+// update merges the provided remote timestamp into the clock, so following local timestamps are
+// greater than the remote one.
+func (c *clock) update(remote timestamp) {
+	c.mutex.Lock()
+	if remote > c.last {
+		c.last = remote
+	}
+	c.mutex.Unlock()
+}
@@ -13,10 +13,39 @@ import (
 
 type options struct {
 	ListenURL             string        `short:"l" long:"listen" default:"tcp://localhost:0" description:"listener address"`
+	TLSCertFile           string        `long:"tls-cert" description:"pem encoded certificate for the tls listener and peer connections"`
+	TLSKeyFile            string        `long:"tls-key" description:"pem encoded key of the tls certificate"`
+	TLSCAFile             string        `long:"tls-ca" description:"pem encoded certificates to verify peers. if omitted, the system's pool is used"`
+	TLSVerifyClients      bool          `long:"tls-verify-clients" description:"require clients to present a certificate signed by the tls ca"`
+	UsersFile             string        `long:"users" description:"json file with the users, their roles and acls. if omitted, no authentication is required"`
+	PeerUser              string        `long:"peer-user" default:"default" description:"user to authenticate at the peers"`
+	PeerPassword          string        `long:"peer-password" description:"password to authenticate at the peers"`
+	ClusterName           string        `short:"c" long:"cluster" default:"deks" description:"name of the cluster. only nodes of the same cluster exchange data"`
+	AdvertiseURL          string        `long:"advertise" description:"address that is announced to other cluster members. if omitted, the listener address is used"`
+	JoinURLs              []string      `short:"j" long:"join" description:"address of a cluster member to join. multiple specifications possible"`
+	ProbeInterval         time.Duration `long:"probe-interval" default:"1s" description:"interval in which a random cluster member is probed. zero disables the membership"`
+	ProbeTimeout          time.Duration `long:"probe-timeout" default:"500ms" description:"duration a cluster member has to respond to a probe"`
+	SuspectTimeout        time.Duration `long:"suspect-timeout" default:"5s" description:"duration after which an unresponsive cluster member is removed"`
 	PeerURLs              []string      `short:"p" long:"peer" description:"address of target node. multiple specifications possible"`
 	PeerPingInterval      time.Duration `short:"b" long:"peer-ping-interval" default:"500ms" description:"interval in which a peer is pinged in order to test it's availbility"`
 	PeerReconnectInterval time.Duration `short:"r" long:"peer-reconnect-interval" default:"5s" description:"duration after which a failing peer is reconnected"`
+	PeerQueueSize         int           `long:"peer-queue-size" default:"1024" description:"number of updates that are queued for each peer"`
+	PeerQueueOverflow     string        `long:"peer-queue-overflow" default:"drop" choice:"drop" choice:"block" description:"policy that is applied if a peer's queue is full"`
+	PeerQueueTimeout      time.Duration `long:"peer-queue-timeout" default:"100ms" description:"duration a write blocks on a full queue with the block policy"`
+	PeerBatchSize         int           `long:"peer-batch-size" default:"65536" description:"number of bytes that are collected before a batch of updates is sent to a peer"`
+	PeerBatchLinger       time.Duration `long:"peer-batch-linger" default:"2ms" description:"duration an incomplete batch of updates is held back. zero sends updates immediately"`
+	RelayHops             int           `long:"relay-hops" default:"0" description:"number of times an update is relayed from peer to peer. zero disables the relay"`
+	ForwardMessages       bool          `long:"forward-messages" description:"forward published messages to all peers"`
+	ReconcileInterval     time.Duration `short:"a" long:"reconcile-interval" default:"1m" description:"interval in which the node reconciles with it's peers. zero disables the periodic reconciliation"`
+	ReconcilePeerCount    int           `long:"reconcile-peer-count" default:"0" description:"number of random peers to reconcile with in each interval. zero means all peers"`
+	ReconcileBatchSize    int           `long:"reconcile-batch-size" default:"1000" description:"number of values that are fetched with a single request during a reconciliation"`
+	ReconcileParallelism  int           `long:"reconcile-parallelism" default:"4" description:"number of concurrent requests during a reconciliation"`
 	TidyInterval          time.Duration `short:"t" long:"tidy-interval" default:"5s" description:"interval in which the store is cleaned up"`
+	TombstoneGracePeriod  time.Duration `short:"g" long:"tombstone-grace-period" default:"1h" description:"minimal duration for which deleted values are kept"`
+	ExpireInterval        time.Duration `short:"e" long:"expire-interval" default:"1s" description:"interval in which expired values are deleted"`
+	DataDir               string        `short:"d" long:"data-dir" description:"directory where the data is persisted. if omitted, the data is only held in memory"`
+	DisableSync           bool          `long:"disable-sync" description:"don't sync the write-ahead log to disk after each write"`
+	SnapshotInterval      time.Duration `short:"s" long:"snapshot-interval" default:"1m" description:"interval in which the write-ahead log is compacted into a snapshot"`
 }
 
 var (
@@ -33,19 +62,60 @@ func main() {
 		}
 	}
 
+	overflowPolicy, err := deks.ParseOverflowPolicy(opts.PeerQueueOverflow)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	users := []deks.User{}
+	if opts.UsersFile != "" {
+		if users, err = deks.LoadUsers(opts.UsersFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	deks, err := deks.NewNode(deks.Options{
-		ListenURL:             opts.ListenURL,
-		PeerURLs:              opts.PeerURLs,
-		PeerPingInterval:      opts.PeerPingInterval,
-		PeerReconnectInterval: opts.PeerReconnectInterval,
-		TidyInterval:          opts.TidyInterval,
+		ListenURL:               opts.ListenURL,
+		TLSCertFile:             opts.TLSCertFile,
+		TLSKeyFile:              opts.TLSKeyFile,
+		TLSCAFile:               opts.TLSCAFile,
+		TLSVerifyClients:        opts.TLSVerifyClients,
+		Users:                   users,
+		PeerUser:                opts.PeerUser,
+		PeerPassword:            opts.PeerPassword,
+		ClusterName:             opts.ClusterName,
+		AdvertiseURL:            opts.AdvertiseURL,
+		JoinURLs:                opts.JoinURLs,
+		ProbeInterval:           opts.ProbeInterval,
+		ProbeTimeout:            opts.ProbeTimeout,
+		SuspectTimeout:          opts.SuspectTimeout,
+		PeerURLs:                opts.PeerURLs,
+		PeerPingInterval:        opts.PeerPingInterval,
+		PeerReconnectInterval:   opts.PeerReconnectInterval,
+		PeerQueueSize:           opts.PeerQueueSize,
+		PeerQueueOverflowPolicy: overflowPolicy,
+		PeerQueueTimeout:        opts.PeerQueueTimeout,
+		PeerBatchSize:           opts.PeerBatchSize,
+		PeerBatchLinger:         opts.PeerBatchLinger,
+		RelayHops:               opts.RelayHops,
+		ForwardMessages:         opts.ForwardMessages,
+		ReconcileInterval:       opts.ReconcileInterval,
+		ReconcilePeerCount:      opts.ReconcilePeerCount,
+		ReconcileBatchSize:      opts.ReconcileBatchSize,
+		ReconcileParallelism:    opts.ReconcileParallelism,
+		TidyInterval:            opts.TidyInterval,
+		TombstoneGracePeriod:    opts.TombstoneGracePeriod,
+		ExpireInterval:          opts.ExpireInterval,
+		DataDir:                 opts.DataDir,
+		DisableSync:             opts.DisableSync,
+		SnapshotInterval:        opts.SnapshotInterval,
 	}, deks.NewMetricLog())
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Printf("node is listing at %s", deks.ListenURL())
 
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	<-ch
 
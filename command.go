@@ -0,0 +1,267 @@
+package deks
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/simia-tech/errx"
+	redisserver "github.com/tidwall/redcon"
+)
+
+// keyAccess defines the access, a command needs to it's keys.
+type keyAccess int
+
+const (
+	keyAccessNone keyAccess = iota
+	keyAccessRead
+	keyAccessWrite
+)
+
+// commandSpec defines the requirements of a command.
+type commandSpec struct {
+	// arity defines the number of arguments including the command name. A negative arity
+	// defines the minimal number of arguments.
+	arity int
+
+	// role defines the role, that is needed to run the command. If empty, the command can be run
+	// without authentication.
+	role Role
+
+	// access defines the access, that is needed to the keys of the command. The keys are located
+	// at the positions firstKey to lastKey with the step keyStep. The positions are counted like
+	// the arity and a negative lastKey is counted from the end.
+	access   keyAccess
+	firstKey int
+	lastKey  int
+	keyStep  int
+
+	// internal defines whether the command is only used between nodes. Internal commands are not
+	// listed.
+	internal bool
+}
+
+var commands = map[string]commandSpec{
+	cmdHelp:         {arity: 1},
+	cmdQuit:         {arity: 1},
+	cmdPing:         {arity: -1},
+	cmdAuth:         {arity: -2},
+	cmdSet:          {arity: -3, role: RoleClient, access: keyAccessWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	cmdGet:          {arity: 2, role: RoleClient, access: keyAccessRead, firstKey: 1, lastKey: 1, keyStep: 1},
+	cmdGetRev:       {arity: 2, role: RoleClient, access: keyAccessRead, firstKey: 1, lastKey: 1, keyStep: 1},
+	cmdCompareSet:   {arity: 4, role: RoleClient, access: keyAccessWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	cmdCompareDel:   {arity: 3, role: RoleClient, access: keyAccessWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	cmdDelete:       {arity: -2, role: RoleClient, access: keyAccessWrite, firstKey: 1, lastKey: -1, keyStep: 1},
+	cmdExists:       {arity: -2, role: RoleClient, access: keyAccessRead, firstKey: 1, lastKey: -1, keyStep: 1},
+	cmdMGet:         {arity: -2, role: RoleClient, access: keyAccessRead, firstKey: 1, lastKey: -1, keyStep: 1},
+	cmdMSet:         {arity: -3, role: RoleClient, access: keyAccessWrite, firstKey: 1, lastKey: -1, keyStep: 2},
+	cmdKeys:         {arity: -1, role: RoleClient},
+	cmdScan:         {arity: -2, role: RoleClient},
+	cmdRange:        {arity: -4, role: RoleClient},
+	cmdPrefix:       {arity: -3, role: RoleClient},
+	cmdDBSize:       {arity: 1, role: RoleClient},
+	cmdExpire:       {arity: 3, role: RoleClient, access: keyAccessWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	cmdPExpire:      {arity: 3, role: RoleClient, access: keyAccessWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	cmdTTL:          {arity: 2, role: RoleClient, access: keyAccessRead, firstKey: 1, lastKey: 1, keyStep: 1},
+	cmdPersist:      {arity: 2, role: RoleClient, access: keyAccessWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	cmdMeta:         {arity: 2, role: RoleClient, access: keyAccessRead, firstKey: 1, lastKey: 1, keyStep: 1},
+	cmdPeerAdd:      {arity: 4, role: RoleAdmin},
+	cmdPeerRemove:   {arity: 2, role: RoleAdmin},
+	cmdPeerList:     {arity: 1, role: RoleAdmin},
+	cmdTidy:         {arity: 1, role: RoleAdmin},
+	cmdMembers:      {arity: 1, role: RoleAdmin},
+	cmdInfo:         {arity: -1, role: RoleClient},
+	cmdEcho:         {arity: 2, role: RoleClient},
+	cmdSelect:       {arity: 2, role: RoleClient},
+	cmdCommand:      {arity: -1},
+	cmdMulti:        {arity: 1, role: RoleClient},
+	cmdExec:         {arity: 1, role: RoleClient},
+	cmdDiscard:      {arity: 1, role: RoleClient},
+	cmdWatch:        {arity: -2, role: RoleClient, access: keyAccessRead, firstKey: 1, lastKey: -1, keyStep: 1},
+	cmdUnwatch:      {arity: 1, role: RoleClient},
+	cmdObserve:      {arity: -2, role: RoleClient},
+	cmdUnobserve:    {arity: -1, role: RoleClient},
+	cmdPublish:      {arity: 3, role: RoleClient},
+	cmdSubscribe:    {arity: -2, role: RoleClient},
+	cmdUnsubscribe:  {arity: -1, role: RoleClient},
+	cmdPSubscribe:   {arity: -2, role: RoleClient},
+	cmdPUnsubscribe: {arity: -1, role: RoleClient},
+	cmdHello:        {arity: 4, role: RolePeer},
+	cmdSetContainer: {arity: -2, role: RolePeer, internal: true},
+	cmdGetContainer: {arity: 2, role: RolePeer, internal: true},
+	cmdGetBatch:     {arity: -1, role: RolePeer, internal: true},
+	cmdSetBatch:     {arity: -1, role: RolePeer, internal: true},
+	cmdGetRevisions: {arity: -1, role: RolePeer, internal: true},
+	cmdReconcilate:  {arity: 1, role: RolePeer, internal: true},
+	cmdMemberPing:   {arity: -1, role: RolePeer, internal: true},
+	cmdMemberPingRq: {arity: -2, role: RolePeer, internal: true},
+	cmdPeerPublish:  {arity: 5, role: RolePeer, internal: true},
+}
+
+// checkArity returns true, if the provided number of arguments (excluding the command name)
+// matches the arity.
+func (cs commandSpec) checkArity(count int) bool {
+	if cs.arity < 0 {
+		return count+1 >= -cs.arity
+	}
+	return count+1 == cs.arity
+}
+
+// keys returns the keys in the provided arguments (excluding the command name).
+func (cs commandSpec) keys(arguments [][]byte) [][]byte {
+	if cs.firstKey == 0 {
+		return nil
+	}
+	last := cs.lastKey
+	if last < 0 {
+		last = len(arguments) + 1 + last
+	}
+	keys := [][]byte{}
+	for position := cs.firstKey; position <= last && position <= len(arguments); position += cs.keyStep {
+		keys = append(keys, arguments[position-1])
+	}
+	return keys
+}
+
+// flags returns the flags of the command in the format of the redis COMMAND command.
+func (cs commandSpec) flags() []string {
+	flags := []string{}
+	switch cs.access {
+	case keyAccessRead:
+		flags = append(flags, "readonly")
+	case keyAccessWrite:
+		flags = append(flags, "write")
+	}
+	if cs.role == RoleAdmin {
+		flags = append(flags, "admin")
+	}
+	if cs.role == "" {
+		flags = append(flags, "no-auth")
+	}
+	return flags
+}
+
+// writeCommandInfo writes the reply of the COMMAND command. Internal commands are not listed.
+func writeCommandInfo(w *redisserver.Writer, arguments [][]byte) error {
+	names := []string{}
+	subcommand := ""
+	if len(arguments) > 0 {
+		subcommand = strings.ToLower(string(arguments[0]))
+	}
+	switch subcommand {
+	case "":
+		for name, spec := range commands {
+			if !spec.internal {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	case "count":
+		count := 0
+		for _, spec := range commands {
+			if !spec.internal {
+				count++
+			}
+		}
+		w.WriteInt(count)
+		return nil
+	case "info":
+		for _, argument := range arguments[1:] {
+			names = append(names, strings.ToLower(string(argument)))
+		}
+	case "docs":
+		w.WriteArray(0)
+		return nil
+	default:
+		return replyError(fmt.Sprintf("ERR unknown subcommand '%s'", arguments[0]))
+	}
+
+	w.WriteArray(len(names))
+	for _, name := range names {
+		spec, ok := commands[name]
+		if !ok || spec.internal {
+			w.WriteNull()
+			continue
+		}
+		w.WriteArray(6)
+		w.WriteBulkString(name)
+		w.WriteInt(spec.arity)
+		flags := spec.flags()
+		w.WriteArray(len(flags))
+		for _, flag := range flags {
+			w.WriteString(flag)
+		}
+		w.WriteInt(spec.firstKey)
+		w.WriteInt(spec.lastKey)
+		w.WriteInt(spec.keyStep)
+	}
+	return nil
+}
+
+// replyError defines an error, that is replied to the client as it is.
+type replyError string
+
+func (re replyError) Error() string {
+	return string(re)
+}
+
+const (
+	errSyntax     = replyError("ERR syntax error")
+	errNotInteger = replyError("ERR value is not an integer or out of range")
+	errNoAuth     = replyError("NOAUTH Authentication required.")
+	errWrongPass  = replyError("WRONGPASS invalid username-password pair")
+
+	errMembershipDisabled = replyError("ERR membership is disabled")
+)
+
+func errUnknownCommand(command string) error {
+	return replyError(fmt.Sprintf("ERR unknown command '%s'", command))
+}
+
+func errWrongArity(command string) error {
+	return replyError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", command))
+}
+
+func errNoPerm(format string, args ...interface{}) error {
+	return replyError("NOPERM " + fmt.Sprintf(format, args...))
+}
+
+func errPushContext(command string) error {
+	return replyError(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / OBSERVE / UNOBSERVE / PING / QUIT are allowed in this context", command))
+}
+
+// errorReply returns the error message, that is replied to the client for the provided error.
+func errorReply(err error) string {
+	if re, ok := errx.Cause(err).(replyError); ok {
+		return string(re)
+	}
+	return "ERR " + err.Error()
+}
+
+// checkCommand returns an error, if the command is unknown, has a wrong number of arguments or
+// isn't allowed in the current session.
+func (s *Server) checkCommand(ss *session, command string, arguments [][]byte) error {
+	spec, ok := commands[command]
+	if !ok {
+		return errUnknownCommand(command)
+	}
+	if !spec.checkArity(len(arguments)) {
+		return errWrongArity(command)
+	}
+	if err := s.authorize(ss.user, command, spec, arguments); err != nil {
+		return err
+	}
+	if ss.subscriptionCount() > 0 && !pushCommands[command] {
+		return errPushContext(command)
+	}
+	return nil
+}
+
+func parseKeyHash(argument []byte) (keyHash, error) {
+	kh := keyHash{}
+	if len(argument) != keyHashSize {
+		return kh, errx.BadRequestf("invalid key hash size %d", len(argument))
+	}
+	copy(kh[:], argument)
+	return kh, nil
+}
@@ -0,0 +1,302 @@
+package deks_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simia-tech/deks"
+)
+
+func TestServerCommandErrors(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(e.serverOne.ListenURL(), "tcp://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	testFn := func(request, expectReply string) func(*testing.T) {
+		return func(t *testing.T) {
+			_, err := conn.Write([]byte(request))
+			require.NoError(t, err)
+			reply, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, expectReply, reply)
+		}
+	}
+
+	t.Run("UnknownCommand", testFn("*1\r\n$3\r\nfoo\r\n", "-ERR unknown command 'foo'\r\n"))
+	t.Run("MissingArgument", testFn("*2\r\n$3\r\nset\r\n$3\r\nkey\r\n", "-ERR wrong number of arguments for 'set' command\r\n"))
+	t.Run("TooManyArguments", testFn("*3\r\n$3\r\nget\r\n$3\r\nkey\r\n$3\r\nkey\r\n", "-ERR wrong number of arguments for 'get' command\r\n"))
+	t.Run("InvalidOption", testFn("*4\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n$2\r\nyy\r\n", "-ERR syntax error\r\n"))
+	t.Run("NotAnInteger", testFn("*3\r\n$6\r\nexpire\r\n$3\r\nkey\r\n$3\r\none\r\n", "-ERR value is not an integer or out of range\r\n"))
+	t.Run("HiddenCommand", testFn("*2\r\n$5\r\nhello\r\n$3\r\nkey\r\n", "-ERR wrong number of arguments for 'hello' command\r\n"))
+	t.Run("ConnectionStaysOpen", testFn("*1\r\n$4\r\nping\r\n", "+OK\r\n"))
+}
+
+func FuzzServerCommands(f *testing.F) {
+	e := setUpTestEnvironment(f)
+	defer e.tearDown()
+	address := strings.TrimPrefix(e.serverOne.ListenURL(), "tcp://")
+
+	f.Add([]byte("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"))
+	f.Add([]byte("*2\r\n$3\r\nset\r\n$3\r\nkey\r\n"))
+	f.Add([]byte("*2\r\n$4\r\ncset\r\n$1\r\nx\r\n"))
+	f.Add([]byte("*4\r\n$5\r\nhello\r\n$1\r\nx\r\n$1\r\ny\r\n$1\r\nz\r\n"))
+	f.Add([]byte("get\r\n"))
+	f.Add([]byte("*-1\r\n*0\r\n$-1\r\n"))
+
+	f.Fuzz(func(t *testing.T, request []byte) {
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		conn.Write(request)
+		conn.Write([]byte("*1\r\n$4\r\nquit\r\n"))
+		bufio.NewReader(conn).WriteTo(&strings.Builder{})
+		conn.Close()
+
+		client, err := deks.Dial(e.serverOne.ListenURL())
+		require.NoError(t, err)
+		defer client.Close()
+		require.NoError(t, client.Ping())
+	})
+}
+
+func TestServerRedisCommands(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	client, err := redis.Dial("tcp", strings.TrimPrefix(e.serverOne.ListenURL(), "tcp://"))
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.Cmd("MSET", "one", "1", "two", "2", "three", "3").Err)
+
+	t.Run("Exists", func(t *testing.T) {
+		count, err := client.Cmd("EXISTS", "one", "two", "four").Int()
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("MGet", func(t *testing.T) {
+		items, err := client.Cmd("MGET", "one", "four").Array()
+		require.NoError(t, err)
+		require.Len(t, items, 2)
+		value, err := items[0].Str()
+		require.NoError(t, err)
+		assert.Equal(t, "1", value)
+		assert.True(t, items[1].IsType(redis.Nil))
+	})
+
+	t.Run("MSetWithOddArguments", func(t *testing.T) {
+		assert.Error(t, client.Cmd("MSET", "one", "1", "two").Err)
+	})
+
+	t.Run("DBSize", func(t *testing.T) {
+		count, err := client.Cmd("DBSIZE").Int()
+		require.NoError(t, err)
+		assert.Equal(t, 3, count)
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		keys, cursor := []string{}, "0"
+		for {
+			items, err := client.Cmd("SCAN", cursor, "MATCH", "t*", "COUNT", "1").Array()
+			require.NoError(t, err)
+			require.Len(t, items, 2)
+			cursor, err = items[0].Str()
+			require.NoError(t, err)
+			page, err := items[1].List()
+			require.NoError(t, err)
+			keys = append(keys, page...)
+			if cursor == "0" {
+				break
+			}
+		}
+		assert.ElementsMatch(t, []string{"two", "three"}, keys)
+	})
+
+	t.Run("Keys", func(t *testing.T) {
+		keys, err := client.Cmd("KEYS", "[ot]*e").List()
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"one", "three"}, keys)
+	})
+
+	t.Run("Info", func(t *testing.T) {
+		info, err := client.Cmd("INFO", "keyspace").Str()
+		require.NoError(t, err)
+		assert.Equal(t, "# Keyspace\r\ndb0:keys=3,deleted=0\r\n", info)
+	})
+
+	t.Run("Echo", func(t *testing.T) {
+		message, err := client.Cmd("ECHO", "hello").Str()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", message)
+	})
+
+	t.Run("Select", func(t *testing.T) {
+		assert.NoError(t, client.Cmd("SELECT", "0").Err)
+		assert.Error(t, client.Cmd("SELECT", "1").Err)
+	})
+
+	t.Run("Command", func(t *testing.T) {
+		items, err := client.Cmd("COMMAND", "INFO", "mget", "cset").Array()
+		require.NoError(t, err)
+		require.Len(t, items, 2)
+		info, err := items[0].Array()
+		require.NoError(t, err)
+		require.Len(t, info, 6)
+		arity, err := info[1].Int()
+		require.NoError(t, err)
+		assert.Equal(t, -2, arity)
+		assert.True(t, items[1].IsType(redis.Nil))
+	})
+
+	t.Run("SetConditions", func(t *testing.T) {
+		assert.True(t, client.Cmd("SET", "one", "1", "NX").IsType(redis.Nil))
+		assert.True(t, client.Cmd("SET", "four", "4", "XX").IsType(redis.Nil))
+		assert.NoError(t, client.Cmd("SET", "one", "1", "XX", "EX", "10").Err)
+		assert.Error(t, client.Cmd("SET", "one", "1", "XX", "NX").Err)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		count, err := client.Cmd("DEL", "one", "two", "four").Int()
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("DBSizeIgnoresExpired", func(t *testing.T) {
+		require.NoError(t, client.Cmd("SET", "expiring", "1", "PX", "1").Err)
+		time.Sleep(10 * time.Millisecond)
+
+		count, err := client.Cmd("DBSIZE").Int()
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+}
+
+func TestServerKeysWithManyWildcards(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	key := strings.Repeat("a", 64)
+	require.NoError(t, e.storeOne.Set([]byte(key), testValue))
+
+	client, err := redis.Dial("tcp", strings.TrimPrefix(e.serverOne.ListenURL(), "tcp://"))
+	require.NoError(t, err)
+	defer client.Close()
+
+	start := time.Now()
+	keys, err := client.Cmd("KEYS", strings.Repeat("*a", 16)+"*b").List()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	keys, err = client.Cmd("KEYS", strings.Repeat("*a", 16)+"*").List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestServerTransactions(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	address := strings.TrimPrefix(e.serverOne.ListenURL(), "tcp://")
+	client, err := redis.Dial("tcp", address)
+	require.NoError(t, err)
+	defer client.Close()
+	otherClient, err := redis.Dial("tcp", address)
+	require.NoError(t, err)
+	defer otherClient.Close()
+
+	t.Run("Exec", func(t *testing.T) {
+		require.NoError(t, client.Cmd("MULTI").Err)
+		queued, err := client.Cmd("SET", "one", "1").Str()
+		require.NoError(t, err)
+		assert.Equal(t, "QUEUED", queued)
+		require.NoError(t, client.Cmd("GET", "one").Err)
+		require.NoError(t, client.Cmd("DEL", "one", "two").Err)
+
+		items, err := client.Cmd("EXEC").Array()
+		require.NoError(t, err)
+		require.Len(t, items, 3)
+		value, err := items[1].Str()
+		require.NoError(t, err)
+		assert.Equal(t, "1", value)
+		count, err := items[2].Int()
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("Discard", func(t *testing.T) {
+		require.NoError(t, client.Cmd("MULTI").Err)
+		require.NoError(t, client.Cmd("SET", "one", "1").Err)
+		require.NoError(t, client.Cmd("DISCARD").Err)
+
+		assert.True(t, client.Cmd("GET", "one").IsType(redis.Nil))
+		assert.EqualError(t, client.Cmd("EXEC").Err, "ERR EXEC without MULTI")
+	})
+
+	t.Run("AbortOnQueueError", func(t *testing.T) {
+		require.NoError(t, client.Cmd("MULTI").Err)
+		require.NoError(t, client.Cmd("SET", "one", "1").Err)
+		assert.Error(t, client.Cmd("KEYS").Err)
+
+		assert.EqualError(t, client.Cmd("EXEC").Err, "EXECABORT Transaction discarded because of previous errors.")
+		assert.True(t, client.Cmd("GET", "one").IsType(redis.Nil))
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		require.NoError(t, client.Cmd("WATCH", "one").Err)
+		require.NoError(t, client.Cmd("MULTI").Err)
+		require.NoError(t, client.Cmd("SET", "one", "1").Err)
+		require.NoError(t, otherClient.Cmd("SET", "one", "2").Err)
+
+		assert.True(t, client.Cmd("EXEC").IsType(redis.Nil))
+		value, err := client.Cmd("GET", "one").Str()
+		require.NoError(t, err)
+		assert.Equal(t, "2", value)
+
+		require.NoError(t, client.Cmd("WATCH", "one").Err)
+		require.NoError(t, client.Cmd("MULTI").Err)
+		require.NoError(t, client.Cmd("SET", "one", "1").Err)
+		items, err := client.Cmd("EXEC").Array()
+		require.NoError(t, err)
+		assert.Len(t, items, 1)
+	})
+}
+
+func TestServerSubscriptions(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	client, err := redis.Dial("tcp", strings.TrimPrefix(e.serverOne.ListenURL(), "tcp://"))
+	require.NoError(t, err)
+	defer client.Close()
+
+	items, err := client.Cmd("SUBSCRIBE", "one").Array()
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	count, err := items[2].Int()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.EqualError(t, client.Cmd("GET", "one").Err,
+		"ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / OBSERVE / UNOBSERVE / PING / QUIT are allowed in this context")
+
+	items, err = client.Cmd("UNSUBSCRIBE").Array()
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	count, err = items[2].Int()
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	assert.True(t, client.Cmd("GET", "one").IsType(redis.Nil))
+}
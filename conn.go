@@ -1,7 +1,13 @@
 package deks
 
 import (
+	"crypto/tls"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/mediocregopher/radix.v2/redis"
 	"github.com/simia-tech/errx"
@@ -11,20 +17,47 @@ import (
 type Conn struct {
 	conn   net.Conn
 	client *redis.Client
+
+	// version holds the protocol version, that has been agreed on with a peer.
+	version int
 }
 
 // Dial establishes a connection to the server at the provided url.
 func Dial(url string) (*Conn, error) {
-	network, address, err := parseURL(url)
+	return DialTLS(url, nil)
+}
+
+// DialTLS establishes a connection to the server at the provided url. For urls in format
+// 'tls://localhost:5000', the provided tls config is used. A nil config uses the system's
+// certificate pool.
+func DialTLS(url string, tlsConfig *tls.Config) (*Conn, error) {
+	return dialTimeout(url, tlsConfig, 0)
+}
+
+// dialTimeout establishes a connection to the server at the provided url. The connection fails
+// if it isn't established or a request isn't answered within the provided timeout. If the
+// timeout is zero, no timeout is applied.
+func dialTimeout(url string, tlsConfig *tls.Config, timeout time.Duration) (*Conn, error) {
+	network, address, secure, err := parseURL(url)
 	if err != nil {
 		return nil, errx.Annotatef(err, "parse url [%s]", url)
 	}
 
-	conn, err := net.Dial(network, address)
+	conn, err := dial(network, address, secure, tlsConfig, timeout)
 	if err != nil {
 		return nil, errx.Annotatef(err, "dial [%s %s]", network, address)
 	}
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			conn.Close()
+			return nil, errx.Annotatef(err, "set deadline")
+		}
+	}
 
+	return newConn(conn)
+}
+
+func newConn(conn net.Conn) (*Conn, error) {
 	client, err := redis.NewClient(conn)
 	if err != nil {
 		return nil, errx.Annotatef(err, "new client")
@@ -59,9 +92,22 @@ func (c *Conn) Set(key, value []byte) error {
 	return nil
 }
 
+// SetWithTTL sets the provided value at the provided key. After the provided ttl, the value
+// expires. The ttl is transmitted with millisecond precision.
+func (c *Conn) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	response := c.client.Cmd(cmdSet, key, value, "PX", int64(ttl/time.Millisecond))
+	if !isOK(response) {
+		return errx.Errorf("set command failed")
+	}
+	return nil
+}
+
 // Get returns the value at the provided key.
 func (c *Conn) Get(key []byte) ([]byte, error) {
 	response := c.client.Cmd(cmdGet, key)
+	if response.IsType(redis.Nil) {
+		return nil, nil
+	}
 	if !response.IsType(redis.Str) {
 		return nil, errx.Errorf("get item command failed")
 	}
@@ -72,15 +118,163 @@ func (c *Conn) Get(key []byte) ([]byte, error) {
 	return bytes, nil
 }
 
+// GetWithMeta returns the entry at the provided key including it's meta data. The value itself
+// is not transmitted. If no entry exists, nil is returned.
+func (c *Conn) GetWithMeta(key []byte) (*Entry, error) {
+	response := c.client.Cmd(cmdMeta, key)
+	if response.IsType(redis.Nil) {
+		return nil, nil
+	}
+	items, err := response.Array()
+	if err != nil {
+		return nil, errx.Annotatef(err, "response array")
+	}
+	if len(items)%2 != 0 {
+		return nil, errx.Errorf("expected field value pairs, got %d items", len(items))
+	}
+	entry := &Entry{Key: key}
+	for index := 0; index < len(items); index += 2 {
+		field, err := items[index].Str()
+		if err != nil {
+			return nil, errx.Annotatef(err, "response field")
+		}
+		value := items[index+1]
+		switch field {
+		case "revision":
+			revision, err := value.Int64()
+			if err != nil {
+				return nil, errx.Annotatef(err, "response revision")
+			}
+			entry.Revision = uint64(revision)
+		case "timestamp":
+			if entry.Timestamp, err = parseTimeResponse(value); err != nil {
+				return nil, errx.Annotatef(err, "response timestamp")
+			}
+		case "origin":
+			if entry.Origin, err = value.Str(); err != nil {
+				return nil, errx.Annotatef(err, "response origin")
+			}
+		case "deleted":
+			deleted, err := value.Int()
+			if err != nil {
+				return nil, errx.Annotatef(err, "response deleted")
+			}
+			entry.Deleted = deleted == 1
+		case "expires":
+			if entry.ExpiresAt, err = parseTimeResponse(value); err != nil {
+				return nil, errx.Annotatef(err, "response expires")
+			}
+		}
+	}
+	return entry, nil
+}
+
 // Delete removes the value at the provided key.
 func (c *Conn) Delete(key []byte) error {
 	response := c.client.Cmd(cmdDelete, key)
-	if !isOK(response) {
-		return errx.Errorf("delete command failed")
+	if _, err := response.Int(); err != nil {
+		return errx.Annotatef(err, "delete command failed")
 	}
 	return nil
 }
 
+// GetWithRevision returns the value at the provided key and it's revision. If no value exists,
+// nil and a zero revision are returned.
+func (c *Conn) GetWithRevision(key []byte) ([]byte, uint64, error) {
+	response := c.client.Cmd(cmdGetRev, key)
+	if response.IsType(redis.Nil) {
+		return nil, 0, nil
+	}
+	items, err := response.Array()
+	if err != nil {
+		return nil, 0, errx.Annotatef(err, "response array")
+	}
+	if len(items) != 2 {
+		return nil, 0, errx.Errorf("expected value and revision, got %d items", len(items))
+	}
+	value, err := items[0].Bytes()
+	if err != nil {
+		return nil, 0, errx.Annotatef(err, "response bytes")
+	}
+	revision, err := items[1].Int64()
+	if err != nil {
+		return nil, 0, errx.Annotatef(err, "response int")
+	}
+	return value, uint64(revision), nil
+}
+
+// CompareAndSet sets the provided value at the provided key, if a value exists and it's revision
+// equals the expected one. If the value has been set, true is returned.
+func (c *Conn) CompareAndSet(key []byte, expectedRevision uint64, value []byte) (bool, error) {
+	response := c.client.Cmd(cmdCompareSet, key, strconv.FormatUint(expectedRevision, 10), value)
+	result, err := response.Int()
+	if err != nil {
+		return false, errx.Annotatef(err, "compare and set command failed")
+	}
+	return result == 1, nil
+}
+
+// SetIfAbsent sets the provided value at the provided key, if no value exists. If the value has
+// been set, true is returned.
+func (c *Conn) SetIfAbsent(key, value []byte) (bool, error) {
+	response := c.client.Cmd(cmdSet, key, value, "NX")
+	if response.IsType(redis.Nil) {
+		return false, nil
+	}
+	if !isOK(response) {
+		return false, errx.Errorf("set command failed")
+	}
+	return true, nil
+}
+
+// DeleteIfRevision removes the value at the provided key, if it's revision equals the provided
+// one. If the value has been removed, true is returned.
+func (c *Conn) DeleteIfRevision(key []byte, revision uint64) (bool, error) {
+	response := c.client.Cmd(cmdCompareDel, key, strconv.FormatUint(revision, 10))
+	result, err := response.Int()
+	if err != nil {
+		return false, errx.Annotatef(err, "delete if revision command failed")
+	}
+	return result == 1, nil
+}
+
+// Expire sets a ttl on the value at the provided key. The ttl is transmitted with millisecond
+// precision and rounded up. If no value exists, false is returned.
+func (c *Conn) Expire(key []byte, ttl time.Duration) (bool, error) {
+	response := c.client.Cmd(cmdPExpire, key, int64((ttl+time.Millisecond-1)/time.Millisecond))
+	result, err := response.Int()
+	if err != nil {
+		return false, errx.Annotatef(err, "response int")
+	}
+	return result == 1, nil
+}
+
+// TTL returns the remaining time-to-live of the value at the provided key with second
+// precision. If no value exists, TTLNotExisting is returned. If the value doesn't expire,
+// TTLNotSet is returned.
+func (c *Conn) TTL(key []byte) (time.Duration, error) {
+	response := c.client.Cmd(cmdTTL, key)
+	result, err := response.Int64()
+	if err != nil {
+		return 0, errx.Annotatef(err, "response int")
+	}
+	if result < 0 {
+		return time.Duration(result), nil
+	}
+	return time.Duration(result) * time.Second, nil
+}
+
+// Persist removes the expiry from the value at the provided key. If no value exists or the
+// value has no expiry, false is returned.
+func (c *Conn) Persist(key []byte) (bool, error) {
+	response := c.client.Cmd(cmdPersist, key)
+	result, err := response.Int()
+	if err != nil {
+		return false, errx.Annotatef(err, "response int")
+	}
+	return result == 1, nil
+}
+
 // Keys returns a slice containing all keys.
 func (c *Conn) Keys() ([][]byte, error) {
 	response := c.client.Cmd(cmdKeys)
@@ -99,6 +293,85 @@ func (c *Conn) Keys() ([][]byte, error) {
 	return keys, nil
 }
 
+// ScanRange returns a page of up to count keys with start <= key < end and the cursor of the next
+// page. An empty end means no limit. The first page is requested with an empty cursor. If all keys
+// have been returned, the returned cursor is empty.
+func (c *Conn) ScanRange(start, end, cursor []byte, count int, reverse bool) ([][]byte, []byte, error) {
+	return c.scanPage(cmdRange, []interface{}{start, end, cursor}, count, reverse)
+}
+
+// ScanPrefix returns a page of up to count keys with the provided prefix and the cursor of the
+// next page. The first page is requested with an empty cursor. If all keys have been returned,
+// the returned cursor is empty.
+func (c *Conn) ScanPrefix(prefix, cursor []byte, count int, reverse bool) ([][]byte, []byte, error) {
+	return c.scanPage(cmdPrefix, []interface{}{prefix, cursor}, count, reverse)
+}
+
+func (c *Conn) scanPage(command string, arguments []interface{}, count int, reverse bool) ([][]byte, []byte, error) {
+	arguments = append(arguments, "COUNT", count)
+	if reverse {
+		arguments = append(arguments, "REV")
+	}
+	response := c.client.Cmd(command, arguments...)
+	items, err := response.Array()
+	if err != nil {
+		return nil, nil, errx.Annotatef(err, "response array")
+	}
+	if len(items) != 2 {
+		return nil, nil, errx.Errorf("expected cursor and keys, got %d items", len(items))
+	}
+	cursor, err := items[0].Bytes()
+	if err != nil {
+		return nil, nil, errx.Annotatef(err, "response cursor")
+	}
+	keyItems, err := items[1].Array()
+	if err != nil {
+		return nil, nil, errx.Annotatef(err, "response keys")
+	}
+	keys := make([][]byte, len(keyItems))
+	for index, item := range keyItems {
+		if keys[index], err = item.Bytes(); err != nil {
+			return nil, nil, errx.Annotatef(err, "response bytes")
+		}
+	}
+	return keys, cursor, nil
+}
+
+// Members returns all members of the cluster.
+func (c *Conn) Members() ([]Member, error) {
+	response := c.client.Cmd(cmdMembers)
+	items, err := response.Array()
+	if err != nil {
+		return nil, errx.Annotatef(err, "response array")
+	}
+	members := make([]Member, len(items))
+	for index, item := range items {
+		fields, err := item.Array()
+		if err != nil {
+			return nil, errx.Annotatef(err, "response array")
+		}
+		if len(fields) != 3 {
+			return nil, errx.Errorf("expected 3 member fields, got %d", len(fields))
+		}
+		if members[index].URL, err = fields[0].Str(); err != nil {
+			return nil, errx.Annotatef(err, "response string")
+		}
+		state, err := fields[1].Str()
+		if err != nil {
+			return nil, errx.Annotatef(err, "response string")
+		}
+		if members[index].State, err = parseMemberState(state); err != nil {
+			return nil, errx.Annotatef(err, "parse member state")
+		}
+		incarnation, err := fields[2].Int64()
+		if err != nil {
+			return nil, errx.Annotatef(err, "response int")
+		}
+		members[index].Incarnation = uint64(incarnation)
+	}
+	return members, nil
+}
+
 // Tidy cleans up the store.
 func (c *Conn) Tidy() error {
 	response := c.client.Cmd(cmdTidy)
@@ -110,22 +383,225 @@ func (c *Conn) Tidy() error {
 
 // Reconsilate sets the server into reconsilation mode and returns the underlying connection.
 func (c *Conn) Reconsilate() (net.Conn, error) {
-	response := c.client.Cmd(cmdReconcilate)
-	if !isOK(response) {
+	// The command is written and the reply is read directly on the connection, because the
+	// buffered reader of the redis client could otherwise consume the first bytes of the
+	// reconsilation protocol.
+	if _, err := fmt.Fprintf(c.conn, "*1\r\n$%d\r\n%s\r\n", len(cmdReconcilate), cmdReconcilate); err != nil {
+		return nil, errx.Annotatef(err, "write reconsilate command")
+	}
+	reply := make([]byte, len(replyOK))
+	if _, err := io.ReadFull(c.conn, reply); err != nil {
+		return nil, errx.Annotatef(err, "read reconsilate reply")
+	}
+	if string(reply) != replyOK {
 		return nil, errx.Errorf("reconsilate command failed")
 	}
 	c.client = nil
 	return c.conn, nil
 }
 
-func (c *Conn) setContainer(kh keyHash, item []byte) error {
-	response := c.client.Cmd(cmdSetContainer, kh[:], item)
+// Watch returns a channel, that receives an event for every change of a key with the provided
+// prefix. Afterwards, the connection is dedicated to the watch and can't be used for other
+// commands. The returned function cancels the watch and closes the connection. If the connection
+// breaks, the channel is closed.
+func (c *Conn) Watch(prefix []byte) (<-chan Event, func(), error) {
+	if err := c.push(cmdObserve, [][]byte{prefix}); err != nil {
+		return nil, nil, err
+	}
+
+	events, done := make(chan Event), make(chan struct{})
+	go func() {
+		defer close(events)
+		for {
+			event, err := parseEvent(c.client.ReadResp())
+			if err != nil {
+				return
+			}
+			select {
+			case events <- event:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return events, c.cancelPush(done), nil
+}
+
+// Publish sends the provided payload to all subscribers of the channel and returns the number of
+// subscribers, that received it on the server.
+func (c *Conn) Publish(channel, payload []byte) (int, error) {
+	response := c.client.Cmd(cmdPublish, channel, payload)
+	if response.Err != nil {
+		return 0, errx.Annotatef(response.Err, "publish")
+	}
+	return response.Int()
+}
+
+// Subscribe returns a channel, that receives all messages sent to one of the provided channels.
+// Afterwards, the connection is dedicated to the subscription and can't be used for other
+// commands. The returned function cancels the subscription and closes the connection.
+func (c *Conn) Subscribe(channels ...[]byte) (<-chan Message, func(), error) {
+	return c.subscribe(cmdSubscribe, channels)
+}
+
+// PSubscribe returns a channel, that receives all messages sent to a channel, that matches one of
+// the provided glob-style patterns. Afterwards, the connection is dedicated to the subscription
+// and can't be used for other commands. The returned function cancels the subscription and
+// closes the connection.
+func (c *Conn) PSubscribe(patterns ...[]byte) (<-chan Message, func(), error) {
+	return c.subscribe(cmdPSubscribe, patterns)
+}
+
+func (c *Conn) subscribe(command string, names [][]byte) (<-chan Message, func(), error) {
+	if err := c.push(command, names); err != nil {
+		return nil, nil, err
+	}
+
+	messages, done := make(chan Message), make(chan struct{})
+	go func() {
+		defer close(messages)
+		for {
+			m, err := parseMessage(c.client.ReadResp())
+			if err != nil {
+				return
+			}
+			select {
+			case messages <- m:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return messages, c.cancelPush(done), nil
+}
+
+// push sends the provided command, that sets the connection into push mode, and reads the
+// confirmation for each of the provided names.
+func (c *Conn) push(command string, names [][]byte) error {
+	response := c.client.Cmd(command, names)
+	for index := range names {
+		if index > 0 {
+			response = c.client.ReadResp()
+		}
+		if response.Err != nil {
+			return errx.Annotatef(response.Err, "%s", command)
+		}
+		if err := checkSubscriptionReply(response, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) cancelPush(done chan struct{}) func() {
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+			c.conn.Close()
+		})
+	}
+}
+
+// setContainer sends the provided containers of the key hash and returns the number of
+// containers, the peer has accepted. Peers of protocol version 1 accept only a single container
+// per request, so each container is sent separately and counted as accepted.
+func (c *Conn) setContainer(kh keyHash, containers ...[]byte) (int, error) {
+	if c.version < 2 {
+		for _, container := range containers {
+			if !isOK(c.client.Cmd(cmdSetContainer, kh[:], container)) {
+				return 0, errx.Errorf("set container command failed")
+			}
+		}
+		return len(containers), nil
+	}
+	accepted, err := c.client.Cmd(cmdSetContainer, kh[:], containers).Int()
+	if err != nil {
+		return 0, errx.Annotatef(err, "set container command")
+	}
+	return accepted, nil
+}
+
+// setContainerBatch sends all provided containers with a single request. Peers of protocol
+// version 1 don't know batches and get a request per container.
+func (c *Conn) setContainerBatch(updates []containerUpdate) error {
+	if c.version < 2 {
+		for index := range updates {
+			if _, err := c.setContainer(updates[index].keyHash, updates[index].bytes); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	arguments := make([]interface{}, 0, 3*len(updates))
+	for index := range updates {
+		arguments = append(arguments, updates[index].keyHash[:], updates[index].hops, updates[index].bytes)
+	}
+	response := c.client.Cmd(cmdSetBatch, arguments...)
 	if !isOK(response) {
-		return errx.Errorf("set container command failed")
+		return errx.Errorf("set container batch command failed")
 	}
 	return nil
 }
 
+func (c *Conn) publishMessage(m message) error {
+	response := c.client.Cmd(cmdPeerPublish, m.id[:], m.hops, m.channel, m.payload)
+	if !isOK(response) {
+		return errx.Errorf("publish message command failed")
+	}
+	return nil
+}
+
+// getContainerBatch fetches the buckets of all provided key hashes with a single request. The
+// result holds the containers of each bucket in the order of the key hashes. Peers of protocol
+// version 1 don't know batches and get a request per key hash.
+func (c *Conn) getContainerBatch(khs []keyHash) ([][][]byte, error) {
+	if c.version < 2 {
+		result := make([][][]byte, len(khs))
+		for index, kh := range khs {
+			container, err := c.getContainer(kh)
+			if err != nil {
+				return nil, err
+			}
+			if len(container) > 0 {
+				result[index] = [][]byte{container}
+			}
+		}
+		return result, nil
+	}
+	arguments := make([]interface{}, len(khs))
+	for index := range khs {
+		arguments[index] = khs[index][:]
+	}
+	response := c.client.Cmd(cmdGetBatch, arguments...)
+	buckets, err := response.Array()
+	if err != nil {
+		return nil, errx.Annotatef(err, "response array")
+	}
+	if len(buckets) != len(khs) {
+		return nil, errx.Errorf("expected %d buckets, got %d", len(khs), len(buckets))
+	}
+	result := make([][][]byte, len(buckets))
+	for index, bucket := range buckets {
+		items, err := bucket.Array()
+		if err != nil {
+			return nil, errx.Annotatef(err, "response array")
+		}
+		containers := make([][]byte, len(items))
+		for itemIndex, item := range items {
+			bytes, err := item.Bytes()
+			if err != nil {
+				return nil, errx.Annotatef(err, "response bytes")
+			}
+			containers[itemIndex] = bytes
+		}
+		result[index] = containers
+	}
+	return result, nil
+}
+
+// getContainer fetches the container of the provided key hash from a peer of protocol version 1,
+// which replies a single bulk. An empty result means, that the peer doesn't hold the key hash.
 func (c *Conn) getContainer(kh keyHash) ([]byte, error) {
 	response := c.client.Cmd(cmdGetContainer, kh[:])
 	if !response.IsType(redis.Str) {
@@ -138,6 +614,127 @@ func (c *Conn) getContainer(kh keyHash) ([]byte, error) {
 	return bytes, nil
 }
 
+func (c *Conn) memberPing(members []Member) ([]Member, error) {
+	return parseMemberResponse(c.client.Cmd(cmdMemberPing, memberArguments(members)...))
+}
+
+func (c *Conn) memberPingRequest(target string, members []Member) (bool, error) {
+	arguments := append([]interface{}{target}, memberArguments(members)...)
+	response := c.client.Cmd(cmdMemberPingRq, arguments...)
+	ok, err := response.Int()
+	if err != nil {
+		return false, errx.Annotatef(err, "response int")
+	}
+	return ok == 1, nil
+}
+
+const replyOK = "+OK\r\n"
+
+func (c *Conn) getRevisions(keys [][]byte) ([]int64, error) {
+	arguments := make([]interface{}, len(keys))
+	for index, key := range keys {
+		arguments[index] = key
+	}
+	response := c.client.Cmd(cmdGetRevisions, arguments...)
+	items, err := response.Array()
+	if err != nil {
+		return nil, errx.Annotatef(err, "response array")
+	}
+	if len(items) != len(keys) {
+		return nil, errx.Errorf("expected %d revisions, got %d", len(keys), len(items))
+	}
+	revisions := make([]int64, len(items))
+	for index, item := range items {
+		revision, err := item.Int64()
+		if err != nil {
+			return nil, errx.Annotatef(err, "response int")
+		}
+		revisions[index] = revision
+	}
+	return revisions, nil
+}
+
+func parseTimeResponse(response *redis.Resp) (time.Time, error) {
+	s, err := response.Str()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func checkSubscriptionReply(response *redis.Resp, command string) error {
+	items, err := response.Array()
+	if err != nil {
+		return errx.Annotatef(err, "array")
+	}
+	if len(items) != 3 {
+		return errx.Errorf("expected 3 items, got %d", len(items))
+	}
+	if kind, _ := items[0].Str(); kind != command {
+		return errx.Errorf("expected %s reply, got [%s]", command, kind)
+	}
+	return nil
+}
+
+func parseMessage(response *redis.Resp) (Message, error) {
+	if response.Err != nil {
+		return Message{}, response.Err
+	}
+	items, err := response.ListBytes()
+	if err != nil {
+		return Message{}, errx.Annotatef(err, "list")
+	}
+	switch {
+	case len(items) == 3 && string(items[0]) == "message":
+		return Message{Channel: items[1], Payload: items[2]}, nil
+	case len(items) == 4 && string(items[0]) == "pmessage":
+		return Message{Pattern: items[1], Channel: items[2], Payload: items[3]}, nil
+	}
+	return Message{}, errx.Errorf("expected message, got %d items", len(items))
+}
+
+func parseEvent(response *redis.Resp) (Event, error) {
+	if response.Err != nil {
+		return Event{}, response.Err
+	}
+	items, err := response.Array()
+	if err != nil {
+		return Event{}, errx.Annotatef(err, "array")
+	}
+	if len(items) != 6 {
+		return Event{}, errx.Errorf("expected 6 items, got %d", len(items))
+	}
+	if kind, _ := items[0].Str(); kind != "event" {
+		return Event{}, errx.Errorf("expected event, got [%s]", kind)
+	}
+	name, err := items[2].Str()
+	if err != nil {
+		return Event{}, errx.Annotatef(err, "type")
+	}
+	eventType, ok := parseEventType(name)
+	if !ok {
+		return Event{}, errx.Errorf("invalid event type [%s]", name)
+	}
+	key, err := items[3].Bytes()
+	if err != nil {
+		return Event{}, errx.Annotatef(err, "key")
+	}
+	var value []byte
+	if !items[4].IsType(redis.Nil) {
+		if value, err = items[4].Bytes(); err != nil {
+			return Event{}, errx.Annotatef(err, "value")
+		}
+	}
+	revision, err := items[5].Int64()
+	if err != nil {
+		return Event{}, errx.Annotatef(err, "revision")
+	}
+	return Event{Type: eventType, Key: key, Value: value, Revision: uint64(revision)}, nil
+}
+
 func isOK(response *redis.Resp) bool {
 	if response.IsType(redis.Str) {
 		if s, _ := response.Str(); s == "OK" {
@@ -1,7 +1,9 @@
 package deks_test
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -39,6 +41,76 @@ func TestConnDelete(t *testing.T) {
 	assert.Len(t, keys, 0)
 }
 
+func TestConnSetWithTTL(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetWithTTL(testKey, testValue, 50*time.Millisecond))
+
+	ttl, err := conn.TTL(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, ttl)
+
+	time.Sleep(60 * time.Millisecond)
+
+	value, err := conn.Get(testKey)
+	require.NoError(t, err)
+	assert.Empty(t, value)
+}
+
+func TestConnExpireAndPersist(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+
+	require.NoError(t, conn.Set(testKey, testValue))
+
+	ok, err := conn.Expire(testKey, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ttl, err := conn.TTL(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, ttl)
+
+	ok, err = conn.Persist(testKey)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ttl, err = conn.TTL(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, deks.TTLNotSet, ttl)
+}
+
+func TestConnExpireWithinSecond(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+
+	require.NoError(t, conn.Set(testKey, testValue))
+
+	ok, err := conn.Expire(testKey, 500*time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	value, err := conn.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+
+	time.Sleep(600 * time.Millisecond)
+
+	value, err = conn.Get(testKey)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+}
+
 func TestConnKeys(t *testing.T) {
 	e := setUpTestEnvironment(t)
 	defer e.tearDown()
@@ -54,6 +126,46 @@ func TestConnKeys(t *testing.T) {
 	assert.Equal(t, testKey, keys[0])
 }
 
+func TestConnGetWithMeta(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+
+	entry, err := conn.GetWithMeta(testKey)
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	require.NoError(t, conn.SetWithTTL(testKey, testValue, time.Minute))
+
+	entry, err = conn.GetWithMeta(testKey)
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	assert.Equal(t, uint64(0), entry.Revision)
+	assert.False(t, entry.Deleted)
+	assert.Equal(t, e.storeOne.NodeID(), entry.Origin)
+	assert.WithinDuration(t, time.Now(), entry.Timestamp, time.Second)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), entry.ExpiresAt, time.Second)
+}
+
+func TestConnMembers(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverOne.SetMembership("", deks.DefaultProbeTimeout, deks.DefaultSuspectTimeout, time.Minute, time.Minute)
+
+	require.NoError(t, e.serverTwo.Join(e.serverOne.ListenURL()))
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	members, err := conn.Members()
+	require.NoError(t, err)
+	assert.Equal(t, e.serverOne.Members(), members)
+}
+
 func TestConnPing(t *testing.T) {
 	e := setUpTestEnvironment(t)
 	defer e.tearDown()
@@ -63,3 +175,153 @@ func TestConnPing(t *testing.T) {
 
 	require.NoError(t, conn.Ping())
 }
+
+func TestConnScanPrefix(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	expected := [][]byte{}
+	for index := 0; index < 25; index++ {
+		key := []byte(fmt.Sprintf("user:42:%02d", index))
+		require.NoError(t, conn.Set(key, testValue))
+		expected = append(expected, key)
+	}
+	require.NoError(t, conn.Set([]byte("user:43:00"), testValue))
+
+	testFn := func(reverse bool) func(*testing.T) {
+		return func(t *testing.T) {
+			keys, cursor, pages := [][]byte{}, []byte{}, 0
+			for {
+				page, next, err := conn.ScanPrefix([]byte("user:42:"), cursor, 10, reverse)
+				require.NoError(t, err)
+				keys = append(keys, page...)
+				pages++
+				if len(next) == 0 {
+					break
+				}
+				cursor = next
+			}
+			assert.Equal(t, 3, pages)
+			if reverse {
+				for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+					keys[i], keys[j] = keys[j], keys[i]
+				}
+			}
+			assert.Equal(t, expected, keys)
+		}
+	}
+
+	t.Run("Ascending", testFn(false))
+	t.Run("Descending", testFn(true))
+}
+
+func TestConnScanRange(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, conn.Set([]byte(key), testValue))
+	}
+
+	keys, cursor, err := conn.ScanRange([]byte("b"), nil, nil, 2, false)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, keys)
+	assert.Equal(t, []byte("d"), cursor)
+
+	keys, cursor, err = conn.ScanRange([]byte("b"), nil, cursor, 2, false)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("d")}, keys)
+	assert.Empty(t, cursor)
+}
+
+func TestConnConditionalWrites(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ok, err := conn.SetIfAbsent(testKey, testValue)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = conn.SetIfAbsent(testKey, testValue)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	value, revision, err := conn.GetWithRevision(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+
+	ok, err = conn.CompareAndSet(testKey, revision+1, []byte("other"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = conn.CompareAndSet(testKey, revision, []byte("other"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = conn.DeleteIfRevision(testKey, revision+1)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	value, _, err = conn.GetWithRevision(testKey)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestConnWatch(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	watchConn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	events, cancel, err := watchConn.Watch([]byte("a/"))
+	require.NoError(t, err)
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	require.NoError(t, conn.Set([]byte("b/1"), testValue))
+	require.NoError(t, conn.Set([]byte("a/1"), testValue))
+	require.NoError(t, conn.Delete([]byte("a/1")))
+
+	assert.Equal(t, deks.Event{Type: deks.EventSet, Key: []byte("a/1"), Value: testValue}, <-events)
+	assert.Equal(t, deks.Event{Type: deks.EventDelete, Key: []byte("a/1"), Revision: 1}, <-events)
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestConnPublishAndSubscribe(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	subscribeConn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	messages, cancel, err := subscribeConn.Subscribe([]byte("one"), []byte("two"))
+	require.NoError(t, err)
+	defer cancel()
+
+	psubscribeConn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	pmessages, pcancel, err := psubscribeConn.PSubscribe([]byte("t*"))
+	require.NoError(t, err)
+	defer pcancel()
+
+	conn, err := deks.Dial(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	count, err := conn.Publish([]byte("two"), testValue)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	assert.Equal(t, deks.Message{Channel: []byte("two"), Payload: testValue}, <-messages)
+	assert.Equal(t, deks.Message{Pattern: []byte("t*"), Channel: []byte("two"), Payload: testValue}, <-pmessages)
+}
@@ -1,21 +1,58 @@
 package deks
 
 import (
+	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"time"
 
 	"github.com/simia-tech/errx"
 )
 
+// The container format starts with a magic number and a version byte. The legacy format, that
+// came without both, is detected by the missing magic number, since it starts with the big
+// endian revision, which never reaches that high.
+//
+// Version 1 layout:
+//
+//	magic (2) | version (1) | reserved (1) | revision (8) | deleted at (8) | expires at (8) |
+//	timestamp (8) | origin (8) | key length (4) | value length (4) | key | value | crc32 (4)
+//
+// Legacy layout:
+//
+//	revision (8) | deleted at (8) | key length (2) | padding (2) | key | value
+const (
+	containerMagic0 = 0xd3
+	containerMagic1 = 0x4b
+
+	containerVersionLegacy  = 0
+	containerVersion1       = 1
+	containerVersionCurrent = containerVersion1
+
+	containerHeaderSize       = 52
+	containerChecksumSize     = 4
+	containerLegacyHeaderSize = 20
+
+	maxContainerKeyLength = 1<<16 - 1
+)
+
 type container struct {
 	key       []byte
 	value     []byte
 	revision  uint64
 	deletedAt time.Time
+	expiresAt time.Time
+	timestamp timestamp
+	origin    nodeID
+
+	// hops holds the number of times the container has been relayed by other nodes. It's not
+	// part of the binary format, but transferred along with it.
+	hops int
 }
 
 func (c *container) delete() {
 	c.deletedAt = time.Now()
+	c.expiresAt = time.Time{}
 }
 
 func (c *container) undelete() {
@@ -26,26 +63,134 @@ func (c *container) isDeleted() bool {
 	return !c.deletedAt.IsZero()
 }
 
+func (c *container) isExpired(now time.Time) bool {
+	return !c.expiresAt.IsZero() && !c.expiresAt.After(now)
+}
+
+// newerThan returns true if the container supersedes the other container. The higher revision
+// wins. On equal revisions, the higher timestamp and finally the higher origin node id wins, so
+// concurrent writes are resolved the same way on all nodes.
+func (c *container) newerThan(other *container) bool {
+	if c.revision != other.revision {
+		return c.revision > other.revision
+	}
+	if c.timestamp != other.timestamp {
+		return c.timestamp > other.timestamp
+	}
+	return bytes.Compare(c.origin[:], other.origin[:]) > 0
+}
+
+// MarshalBinary encodes the container in the current format version. Containers sent to peers
+// are encoded in the format version, that has been negotiated with the peer.
 func (c *container) MarshalBinary() ([]byte, error) {
-	keyLength := uint16(len(c.key))
-	valueLength := len(c.value)
-	buffer := make([]byte, int(keyLength)+valueLength+20)
-	binary.BigEndian.PutUint64(buffer[:8], c.revision)
-	binary.BigEndian.PutUint64(buffer[8:16], uint64(c.deletedAt.Unix()))
-	binary.BigEndian.PutUint16(buffer[16:20], keyLength)
-	copy(buffer[20:20+keyLength], c.key)
-	copy(buffer[20+keyLength:], c.value)
-	return buffer, nil
+	return c.marshalBinaryVersion(containerVersionCurrent)
+}
+
+// marshalBinaryVersion encodes the container in the provided format version. Fields that are
+// not supported by the legacy format are dropped.
+func (c *container) marshalBinaryVersion(version byte) ([]byte, error) {
+	if len(c.key) > maxContainerKeyLength {
+		return nil, errx.BadRequestf("key length %d exceeds maximum of %d", len(c.key), maxContainerKeyLength)
+	}
+	switch version {
+	case containerVersionLegacy:
+		buffer := make([]byte, containerLegacyHeaderSize+len(c.key)+len(c.value))
+		binary.BigEndian.PutUint64(buffer[:8], c.revision)
+		binary.BigEndian.PutUint64(buffer[8:16], uint64(c.deletedAt.Unix()))
+		binary.BigEndian.PutUint16(buffer[16:18], uint16(len(c.key)))
+		copy(buffer[containerLegacyHeaderSize:], c.key)
+		copy(buffer[containerLegacyHeaderSize+len(c.key):], c.value)
+		return buffer, nil
+	case containerVersion1:
+		keyLength, valueLength := len(c.key), len(c.value)
+		buffer := make([]byte, containerHeaderSize+keyLength+valueLength+containerChecksumSize)
+		buffer[0] = containerMagic0
+		buffer[1] = containerMagic1
+		buffer[2] = containerVersion1
+		binary.BigEndian.PutUint64(buffer[4:12], c.revision)
+		binary.BigEndian.PutUint64(buffer[12:20], uint64(unixOrZero(c.deletedAt)))
+		if !c.expiresAt.IsZero() {
+			binary.BigEndian.PutUint64(buffer[20:28], uint64(c.expiresAt.UnixNano()))
+		}
+		binary.BigEndian.PutUint64(buffer[28:36], uint64(c.timestamp))
+		copy(buffer[36:44], c.origin[:])
+		binary.BigEndian.PutUint32(buffer[44:48], uint32(keyLength))
+		binary.BigEndian.PutUint32(buffer[48:52], uint32(valueLength))
+		copy(buffer[containerHeaderSize:], c.key)
+		copy(buffer[containerHeaderSize+keyLength:], c.value)
+		checksumOffset := len(buffer) - containerChecksumSize
+		binary.BigEndian.PutUint32(buffer[checksumOffset:], crc32.ChecksumIEEE(buffer[:checksumOffset]))
+		return buffer, nil
+	default:
+		return nil, errx.NotImplementedf("container format version %d", version)
+	}
 }
 
 func (c *container) UnmarshalBinary(data []byte) error {
-	if len(data) < 20 {
-		return errx.Errorf("need at least 20 bytes")
+	if len(data) < 3 || data[0] != containerMagic0 || data[1] != containerMagic1 {
+		return c.unmarshalLegacy(data)
 	}
+	switch version := data[2]; version {
+	case containerVersion1:
+		return c.unmarshalVersion1(data)
+	default:
+		return errx.NotImplementedf("container format version %d", version)
+	}
+}
+
+func (c *container) unmarshalVersion1(data []byte) error {
+	if len(data) < containerHeaderSize+containerChecksumSize {
+		return errx.BadRequestf("need at least %d bytes, got %d", containerHeaderSize+containerChecksumSize, len(data))
+	}
+	keyLength := uint64(binary.BigEndian.Uint32(data[44:48]))
+	valueLength := uint64(binary.BigEndian.Uint32(data[48:52]))
+	if expected := containerHeaderSize + keyLength + valueLength + containerChecksumSize; expected != uint64(len(data)) {
+		return errx.BadRequestf("expected %d bytes, got %d", expected, len(data))
+	}
+	checksumOffset := len(data) - containerChecksumSize
+	if crc32.ChecksumIEEE(data[:checksumOffset]) != binary.BigEndian.Uint32(data[checksumOffset:]) {
+		return errx.BadRequestf("checksum mismatch")
+	}
+
+	c.revision = binary.BigEndian.Uint64(data[4:12])
+	c.deletedAt = timeOrZero(int64(binary.BigEndian.Uint64(data[12:20])), 0)
+	c.expiresAt = timeOrZero(0, int64(binary.BigEndian.Uint64(data[20:28])))
+	c.timestamp = timestamp(binary.BigEndian.Uint64(data[28:36]))
+	copy(c.origin[:], data[36:44])
+	c.key = data[containerHeaderSize : containerHeaderSize+keyLength]
+	c.value = data[containerHeaderSize+keyLength : checksumOffset]
+	return nil
+}
+
+func (c *container) unmarshalLegacy(data []byte) error {
+	if len(data) < containerLegacyHeaderSize {
+		return errx.BadRequestf("need at least %d bytes, got %d", containerLegacyHeaderSize, len(data))
+	}
+	keyLength := int(binary.BigEndian.Uint16(data[16:18]))
+	if containerLegacyHeaderSize+keyLength > len(data) {
+		return errx.BadRequestf("key length %d exceeds data of %d bytes", keyLength, len(data))
+	}
+
 	c.revision = binary.BigEndian.Uint64(data[:8])
-	c.deletedAt = time.Unix(int64(binary.BigEndian.Uint64(data[8:16])), 0)
-	keyLength := binary.BigEndian.Uint16(data[16:20])
-	c.key = data[20 : 20+keyLength]
-	c.value = data[20+keyLength:]
+	c.deletedAt = timeOrZero(int64(binary.BigEndian.Uint64(data[8:16])), 0)
+	c.expiresAt = time.Time{}
+	c.timestamp = 0
+	c.origin = nodeID{}
+	c.key = data[containerLegacyHeaderSize : containerLegacyHeaderSize+keyLength]
+	c.value = data[containerLegacyHeaderSize+keyLength:]
 	return nil
 }
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(seconds, nanoseconds int64) time.Time {
+	if seconds == 0 && nanoseconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, nanoseconds)
+}
@@ -0,0 +1,78 @@
+package deks
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerMarshalAndUnmarshal(t *testing.T) {
+	c := &container{
+		key:       []byte("key"),
+		value:     []byte("value"),
+		revision:  3,
+		expiresAt: time.Unix(0, 1234567890),
+		timestamp: 42,
+		origin:    nodeID{0x01, 0x02},
+	}
+
+	data, err := c.MarshalBinary()
+	require.NoError(t, err)
+
+	result := &container{}
+	require.NoError(t, result.UnmarshalBinary(data))
+	assert.Equal(t, c.key, result.key)
+	assert.Equal(t, c.value, result.value)
+	assert.Equal(t, c.revision, result.revision)
+	assert.False(t, result.isDeleted())
+	assert.True(t, c.expiresAt.Equal(result.expiresAt))
+	assert.Equal(t, c.timestamp, result.timestamp)
+	assert.Equal(t, c.origin, result.origin)
+}
+
+func TestContainerUnmarshalLegacy(t *testing.T) {
+	data := make([]byte, 20, 28)
+	binary.BigEndian.PutUint64(data[:8], 2)
+	binary.BigEndian.PutUint64(data[8:16], uint64(time.Time{}.Unix()))
+	binary.BigEndian.PutUint16(data[16:20], 3)
+	data = append(data, []byte("keyvalue")...)
+
+	c := &container{}
+	require.NoError(t, c.UnmarshalBinary(data))
+	assert.Equal(t, []byte("key"), c.key)
+	assert.Equal(t, []byte("value"), c.value)
+	assert.Equal(t, uint64(2), c.revision)
+	assert.False(t, c.isDeleted())
+
+	legacyData, err := c.marshalBinaryVersion(containerVersionLegacy)
+	require.NoError(t, err)
+	assert.Equal(t, data, legacyData)
+}
+
+func TestContainerUnmarshalMalformed(t *testing.T) {
+	c := &container{key: []byte("key"), value: []byte("value")}
+	data, err := c.MarshalBinary()
+	require.NoError(t, err)
+
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-5] ^= 0xff
+	assert.Error(t, (&container{}).UnmarshalBinary(corrupted))
+
+	truncated := data[:len(data)-1]
+	assert.Error(t, (&container{}).UnmarshalBinary(truncated))
+
+	oversizedKeyLength := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(oversizedKeyLength[44:48], 0xffffffff)
+	assert.Error(t, (&container{}).UnmarshalBinary(oversizedKeyLength))
+
+	legacy := make([]byte, 20)
+	binary.BigEndian.PutUint16(legacy[16:18], 100)
+	assert.Error(t, (&container{}).UnmarshalBinary(legacy))
+
+	unknownVersion := append([]byte{}, data...)
+	unknownVersion[2] = 99
+	assert.Error(t, (&container{}).UnmarshalBinary(unknownVersion))
+}
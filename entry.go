@@ -0,0 +1,30 @@
+package deks
+
+import "time"
+
+// Entry defines a value together with it's meta data.
+type Entry struct {
+	Key       []byte
+	Value     []byte
+	Revision  uint64
+	Deleted   bool
+	ExpiresAt time.Time
+
+	// Timestamp holds the time of the last write.
+	Timestamp time.Time
+
+	// Origin holds the id of the node that performed the last write.
+	Origin string
+}
+
+func newEntry(c *container) Entry {
+	return Entry{
+		Key:       c.key,
+		Value:     c.value,
+		Revision:  c.revision,
+		Deleted:   c.isDeleted(),
+		ExpiresAt: c.expiresAt,
+		Timestamp: c.timestamp.Time(),
+		Origin:    c.origin.String(),
+	}
+}
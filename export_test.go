@@ -0,0 +1,62 @@
+package deks
+
+import "io"
+
+// SetKeyHashFunc replaces the function that is used to hash the keys of the store.
+func SetKeyHashFunc(s *Store, fn func([]byte) [8]byte) {
+	s.keyHashFn = func(key []byte) keyHash {
+		return keyHash(fn(key))
+	}
+}
+
+// FetchContainers fetches the values of the provided keys from the node at the provided url, like
+// a reconciliation would do.
+func FetchContainers(s *Server, url string, keys [][]byte) error {
+	items := make([][]byte, len(keys))
+	for index, key := range keys {
+		kh := s.store.keyHashFn(key)
+		items[index] = kh[:]
+	}
+	_, err := s.fetchContainers(url, items)
+	return err
+}
+
+// FetchContainersPerKey fetches the values of the provided keys from the node at the provided url
+// with one cget request per key, like the reconciliation did before batching was introduced.
+func FetchContainersPerKey(s *Server, url string, keys [][]byte) error {
+	conn, _, err := s.dialPeer(url, 0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, key := range keys {
+		kh := s.store.keyHashFn(key)
+		containers, err := conn.client.Cmd(cmdGetContainer, kh[:]).ListBytes()
+		if err != nil {
+			return err
+		}
+		for _, c := range containers {
+			if err := s.store.setContainer(kh, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BreakJournal closes the write-ahead log of the store, so all further writes to it fail.
+func BreakJournal(s *Store) error {
+	return s.journal.file.Close()
+}
+
+// TearJournal writes an incomplete record to the write-ahead log of the store, like a write that
+// failed midway.
+func TearJournal(s *Store) error {
+	if _, err := s.journal.file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	record := journalRecord(journalOpSet, keyHash{}, []byte("torn"))
+	_, err := s.journal.file.Write(record[:len(record)/2])
+	return err
+}
@@ -0,0 +1,93 @@
+package deks
+
+// matchPattern returns true, if the provided key matches the glob-style pattern. Like in redis,
+// the pattern supports '*', '?', character classes like '[a-z]' or '[^a]' and escaping with '\'.
+// On a mismatch, only the last '*' is retried with one more byte of the key, so the matching
+// takes at most quadratic time.
+func matchPattern(pattern, key []byte) bool {
+	p, k := 0, 0
+	starP, starK := -1, 0
+	for k < len(key) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				for p < len(pattern) && pattern[p] == '*' {
+					p++
+				}
+				if p == len(pattern) {
+					return true
+				}
+				starP, starK = p, k
+				continue
+			case '?':
+				p++
+				k++
+				continue
+			case '[':
+				if length, ok := matchClass(pattern[p:], key[k]); ok {
+					p += length
+					k++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == key[k] {
+					p += 2
+					k++
+					continue
+				}
+				if p+1 == len(pattern) && key[k] == '\\' {
+					p++
+					k++
+					continue
+				}
+			default:
+				if pattern[p] == key[k] {
+					p++
+					k++
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starK++
+		p, k = starP, starK
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass returns the length of the character class at the beginning of the provided pattern
+// and true, if the provided byte matches it. An unterminated class never matches.
+func matchClass(pattern []byte, b byte) (int, bool) {
+	index := 1
+	not := index < len(pattern) && pattern[index] == '^'
+	if not {
+		index++
+	}
+	match := false
+	for index < len(pattern) && pattern[index] != ']' {
+		switch {
+		case pattern[index] == '\\' && index+1 < len(pattern):
+			index++
+			match = match || pattern[index] == b
+		case index+2 < len(pattern) && pattern[index+1] == '-':
+			start, end := pattern[index], pattern[index+2]
+			if start > end {
+				start, end = end, start
+			}
+			match = match || (b >= start && b <= end)
+			index += 2
+		default:
+			match = match || pattern[index] == b
+		}
+		index++
+	}
+	if index == len(pattern) || match == not {
+		return 0, false
+	}
+	return index + 1, true
+}
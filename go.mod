@@ -1,10 +1,31 @@
 module github.com/simia-tech/deks
 
+go 1.27.1
+
 require (
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/mediocregopher/radix.v2 v0.0.0-20181115013041-b67df6e626f9
+	// conflux is pinned, since recon_tap.go parses it's reconciliation messages.
 	github.com/simia-tech/conflux v0.0.0-20181106104730-883c83fab451
 	github.com/simia-tech/errx v0.1.0
 	github.com/stretchr/testify v1.2.2
 	github.com/tidwall/redcon v0.9.0
 )
+
+require (
+	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/kr/pretty v0.1.0 // indirect
+	github.com/kr/pty v1.1.1 // indirect
+	github.com/kr/text v0.1.0 // indirect
+	github.com/pkg/errors v0.8.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/sirupsen/logrus v1.2.0 // indirect
+	github.com/stretchr/objx v0.1.1 // indirect
+	golang.org/x/crypto v0.0.0-20180904163835-0709b304e793 // indirect
+	golang.org/x/sys v0.0.0-20180905080454-ebe1bf3edb33 // indirect
+	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/errgo.v1 v1.0.0 // indirect
+	gopkg.in/tomb.v2 v2.0.0-20161208151619-d5d1b5820637 // indirect
+)
@@ -0,0 +1,191 @@
+package deks
+
+import (
+	"encoding/hex"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/simia-tech/errx"
+)
+
+const (
+	// DefaultClusterName defines the default name of the cluster.
+	DefaultClusterName = "deks"
+
+	// protocolVersion defines the version of the protocol between nodes. Version 2 introduced the
+	// container format version 1. Nodes talk to each other using the lower of both versions, so a
+	// cluster can be upgraded node by node.
+	protocolVersion = 2
+
+	// minProtocolVersion defines the lowest protocol version, that is still supported. Nodes that
+	// don't know the handshake, are treated as nodes of this version.
+	minProtocolVersion = 1
+)
+
+// handshake defines the information, that nodes exchange before they talk to each other.
+type handshake struct {
+	nodeID      nodeID
+	clusterName string
+	version     int
+}
+
+func (h handshake) arguments() []interface{} {
+	return []interface{}{h.nodeID.String(), h.clusterName, strconv.Itoa(h.version)}
+}
+
+func parseHandshake(arguments [][]byte) (handshake, error) {
+	if len(arguments) != 3 {
+		return handshake{}, errx.BadRequestf("expected node id, cluster name and version, got %d arguments", len(arguments))
+	}
+	h := handshake{clusterName: string(arguments[1])}
+	if len(arguments[0]) != 2*nodeIDSize {
+		return handshake{}, errx.BadRequestf("invalid node id [%s]", arguments[0])
+	}
+	if _, err := hex.Decode(h.nodeID[:], arguments[0]); err != nil {
+		return handshake{}, errx.BadRequestf("invalid node id [%s]", arguments[0])
+	}
+	version, err := strconv.Atoi(string(arguments[2]))
+	if err != nil {
+		return handshake{}, errx.BadRequestf("invalid version [%s]", arguments[2])
+	}
+	h.version = version
+	return h, nil
+}
+
+// check returns the protocol version, that is used with the remote node. If the remote node is
+// incompatible, an error is returned.
+func (h handshake) check(remote handshake) (int, error) {
+	if remote.version < minProtocolVersion {
+		return 0, errx.BadRequestf("incompatible protocol version %d, expected at least %d", remote.version, minProtocolVersion)
+	}
+	if remote.clusterName != h.clusterName {
+		return 0, errx.BadRequestf("cluster [%s] doesn't match [%s]", remote.clusterName, h.clusterName)
+	}
+	if remote.version < h.version {
+		return remote.version, nil
+	}
+	return h.version, nil
+}
+
+// containerVersion returns the container format version, that is understood by nodes of the
+// provided protocol version.
+func containerVersion(protocolVersion int) byte {
+	if protocolVersion < 2 {
+		return containerVersionLegacy
+	}
+	return containerVersion1
+}
+
+// SetClusterName sets the name of the cluster. Only nodes with the same cluster name exchange
+// data.
+func (s *Server) SetClusterName(name string) {
+	s.streamsMutex.Lock()
+	s.clusterName = name
+	s.streamsMutex.Unlock()
+}
+
+func (s *Server) handshake() handshake {
+	s.streamsMutex.RLock()
+	defer s.streamsMutex.RUnlock()
+	return handshake{
+		nodeID:      s.store.nodeID,
+		clusterName: s.clusterName,
+		version:     protocolVersion,
+	}
+}
+
+// dialPeer establishes a connection to the node at the provided url and performs the handshake.
+// If the timeout is zero, no timeout is applied. A connection to this node itself is refused.
+func (s *Server) dialPeer(url string, timeout time.Duration) (*Conn, nodeID, error) {
+	conn, err := dialTimeout(url, s.tlsConfig, timeout)
+	if err != nil {
+		return nil, nodeID{}, errx.Annotatef(err, "dial [%s]", url)
+	}
+
+	if name, password := s.peerCredentials(); password != "" {
+		if err := conn.Auth(name, password); err != nil {
+			conn.Close()
+			return nil, nodeID{}, errx.Annotatef(err, "auth [%s]", url)
+		}
+	}
+
+	local := s.handshake()
+	remote, err := conn.hello(local)
+	if err != nil {
+		conn.Close()
+		return nil, nodeID{}, errx.Annotatef(err, "hello")
+	}
+	if conn.version, err = local.check(remote); err != nil {
+		conn.Close()
+		return nil, nodeID{}, errx.Annotatef(err, "check [%s]", url)
+	}
+	if remote.nodeID == local.nodeID {
+		conn.Close()
+		return nil, nodeID{}, errx.AlreadyExistsf("node at [%s] is this node", url)
+	}
+	return conn, remote.nodeID, nil
+}
+
+// dialStream establishes the connection of the stream to the peer at the provided url. If the
+// peer turns out to be this node or a node that is already connected via another url, the peer
+// is removed.
+func (s *Server) dialStream(url string) (*Conn, error) {
+	conn, id, err := s.dialPeer(url, 0)
+	if err != nil {
+		if errx.IsAlreadyExists(err) {
+			go s.removePeer(url)
+		}
+		return nil, err
+	}
+
+	s.streamsMutex.Lock()
+	for peerURL, peerID := range s.peerIDs {
+		if id != (nodeID{}) && peerID == id && peerURL != url {
+			s.streamsMutex.Unlock()
+			conn.Close()
+			go s.removePeer(url)
+			return nil, errx.AlreadyExistsf("node [%s] at [%s] is already connected at [%s]", id, url, peerURL)
+		}
+	}
+	s.peerIDs[url] = id
+	s.streamsMutex.Unlock()
+
+	return conn, nil
+}
+
+// removePeer removes the peer with the provided url including it's membership entry.
+func (s *Server) removePeer(url string) {
+	s.memberMutex.Lock()
+	delete(s.memberPeers, url)
+	s.memberMutex.Unlock()
+	if err := s.RemovePeer(url); err != nil && !errx.IsNotFound(err) {
+		log.Printf("remove peer [%s]: %v", url, err)
+	}
+}
+
+// hello performs the handshake and returns the remote node's handshake. If the remote node
+// doesn't know the handshake, it's assumed to be a node of the minimal protocol version with an
+// unknown node id.
+func (c *Conn) hello(h handshake) (handshake, error) {
+	response := c.client.Cmd(cmdHello, h.arguments()...)
+	if response.IsType(redis.AppErr) && strings.Contains(response.Err.Error(), "unknown command") {
+		return handshake{clusterName: h.clusterName, version: minProtocolVersion}, nil
+	}
+	if response.IsType(redis.AppErr) {
+		return handshake{}, errx.Errorf("handshake refused: %v", response.Err)
+	}
+	items, err := response.Array()
+	if err != nil {
+		return handshake{}, errx.Annotatef(err, "response array")
+	}
+	arguments := make([][]byte, len(items))
+	for index, item := range items {
+		if arguments[index], err = item.Bytes(); err != nil {
+			return handshake{}, errx.Annotatef(err, "response bytes")
+		}
+	}
+	return parseHandshake(arguments)
+}
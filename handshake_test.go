@@ -0,0 +1,218 @@
+package deks_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simia-tech/deks"
+)
+
+func TestServerHandshakeRejectsOtherCluster(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeTwo.Set(testKey, testValue))
+	e.serverTwo.SetClusterName("other")
+
+	_, err := e.serverOne.Reconcilate(e.serverTwo.ListenURL())
+	assert.Error(t, err)
+
+	value, err := e.storeOne.Get(testKey)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestServerHandshakeRejectsOtherClusterOnStream(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverTwo.SetClusterName("other")
+	require.NoError(t, e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, 20*time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, 0, e.storeTwo.Len())
+}
+
+func TestServerRemovesPeerThatIsItself(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.serverOne.AddPeer(e.serverOne.ListenURL(), time.Minute, time.Minute))
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Empty(t, e.serverOne.PeerURLs())
+}
+
+func TestServerRemovesPeerThatIsAlreadyConnected(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	listenURL := e.serverTwo.ListenURL()
+	require.NoError(t, e.serverOne.AddPeer(listenURL, time.Minute, time.Minute))
+	time.Sleep(50 * time.Millisecond)
+
+	otherURL := strings.Replace(listenURL, "127.0.0.1", "localhost", 1)
+	require.NotEqual(t, listenURL, otherURL)
+	require.NoError(t, e.serverOne.AddPeer(otherURL, time.Minute, time.Minute))
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, []string{listenURL}, e.serverOne.PeerURLs())
+}
+
+func TestServerHandshakeNegotiatesLowerVersion(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	deks.SetKeyHashFunc(e.storeOne, collidingKeyHash)
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+
+	client, err := redis.Dial("tcp", strings.TrimPrefix(e.serverOne.ListenURL(), "tcp://"))
+	require.NoError(t, err)
+	defer client.Close()
+
+	items, err := client.Cmd("hello", "0102030405060708", deks.DefaultClusterName, "1").ListBytes()
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	assert.Equal(t, "2", string(items[2]))
+
+	kh := collidingKeyHash(testKey)
+	reply := client.Cmd("cget", kh[:])
+	require.True(t, reply.IsType(redis.Str))
+	data, err := reply.Bytes()
+	require.NoError(t, err)
+	c, ok := decodeLegacyContainer(data)
+	require.True(t, ok)
+	assert.Equal(t, testKey, c.key)
+	assert.Equal(t, testValue, c.value)
+	assert.Equal(t, uint64(0), c.revision)
+	assert.False(t, c.deleted)
+}
+
+func TestServerHandshakeRejectsUnsupportedVersion(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	client, err := redis.Dial("tcp", strings.TrimPrefix(e.serverOne.ListenURL(), "tcp://"))
+	require.NoError(t, err)
+	defer client.Close()
+
+	assert.Error(t, client.Cmd("hello", "0102030405060708", deks.DefaultClusterName, "0").Err)
+}
+
+func TestServerServesPeerWithoutHandshake(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	deks.SetKeyHashFunc(e.storeOne, collidingKeyHash)
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeOne.Delete(testKey))
+
+	client, err := redis.Dial("tcp", strings.TrimPrefix(e.serverOne.ListenURL(), "tcp://"))
+	require.NoError(t, err)
+	defer client.Close()
+
+	kh := collidingKeyHash(testKey)
+	reply := client.Cmd("cget", kh[:])
+	require.True(t, reply.IsType(redis.Str))
+	data, err := reply.Bytes()
+	require.NoError(t, err)
+	c, ok := decodeLegacyContainer(data)
+	require.True(t, ok)
+	assert.Equal(t, testKey, c.key)
+	assert.Equal(t, uint64(1), c.revision)
+	assert.True(t, c.deleted)
+}
+
+func TestServerStreamsLegacyContainersToPeerWithoutHandshake(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	peer := newLegacyPeer()
+	go peer.serve(l)
+
+	require.NoError(t, e.serverOne.AddPeer("tcp://"+l.Addr().String(), 10*time.Millisecond, time.Minute))
+	time.Sleep(20 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, e.storeOne.Delete(testKey))
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, e.storeOne.Set(testAnotherKey, testAnotherValue))
+
+	expected := []legacyContainer{
+		{key: testKey, value: testValue, revision: 0},
+		{key: testKey, revision: 1, deleted: true},
+		{key: testAnotherKey, value: testAnotherValue, revision: 0},
+	}
+	for _, e := range expected {
+		select {
+		case data := <-peer.received:
+			c, ok := decodeLegacyContainer(data)
+			require.True(t, ok)
+			assert.Equal(t, string(e.key), string(c.key))
+			assert.Equal(t, string(e.value), string(c.value))
+			assert.Equal(t, e.revision, c.revision)
+			assert.Equal(t, e.deleted, c.deleted)
+		case <-time.After(time.Second):
+			t.Fatal("no container received")
+		}
+	}
+}
+
+func TestServerFetchesContainersFromPeerWithoutHandshake(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	peer := newLegacyPeer()
+	peer.store(collidingKeyHash(testKey), encodeLegacyContainer(testKey, testValue, 2))
+	go peer.serve(l)
+
+	deks.SetKeyHashFunc(e.storeOne, collidingKeyHash)
+	require.NoError(t, deks.FetchContainers(e.serverOne, "tcp://"+l.Addr().String(), [][]byte{testKey}))
+
+	value, revision, err := e.storeOne.GetWithRevision(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+	assert.Equal(t, uint64(2), revision)
+}
+
+func TestServerPurgesTombstonesStreamedToPeerWithoutHandshake(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	peer := newLegacyPeer()
+	go peer.serve(l)
+
+	e.storeOne.SetTombstoneGracePeriod(50 * time.Millisecond)
+	require.NoError(t, e.serverOne.AddPeer("tcp://"+l.Addr().String(), 10*time.Millisecond, time.Minute))
+	time.Sleep(20 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeOne.Delete(testKey))
+	time.Sleep(30 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Tidy())
+	require.Equal(t, 1, e.storeOne.DeletedLen())
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, e.storeOne.Tidy())
+	assert.Equal(t, 0, e.storeOne.DeletedLen())
+}
@@ -1,10 +1,124 @@
 package deks_test
 
-import "github.com/simia-tech/deks"
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	redisserver "github.com/tidwall/redcon"
+
+	"github.com/simia-tech/deks"
+)
 
 var (
 	testKey          = []byte("key")
+	testAnotherKey   = []byte("another key")
 	testValue        = []byte("value")
 	testAnotherValue = []byte("another value")
 	testItem         = deks.Item{0x01, 0x02, 0x03, 0x04}
 )
+
+func collidingKeyHash(_ []byte) [8]byte {
+	return [8]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+}
+
+// legacyContainer defines a container as it's decoded by nodes, that only know the legacy format.
+type legacyContainer struct {
+	key      []byte
+	value    []byte
+	revision uint64
+	deleted  bool
+}
+
+// decodeLegacyContainer decodes the provided data the way nodes did before the container format
+// has been versioned. If the data is too short, false is returned.
+func decodeLegacyContainer(data []byte) (legacyContainer, bool) {
+	if len(data) < 20 {
+		return legacyContainer{}, false
+	}
+	keyLength := int(binary.BigEndian.Uint16(data[16:20]))
+	if 20+keyLength > len(data) {
+		return legacyContainer{}, false
+	}
+	return legacyContainer{
+		key:      data[20 : 20+keyLength],
+		value:    data[20+keyLength:],
+		revision: binary.BigEndian.Uint64(data[:8]),
+		deleted:  !time.Unix(int64(binary.BigEndian.Uint64(data[8:16])), 0).IsZero(),
+	}, true
+}
+
+// encodeLegacyContainer encodes the provided values the way nodes did before the container format
+// has been versioned.
+func encodeLegacyContainer(key, value []byte, revision uint64) []byte {
+	data := make([]byte, 20+len(key)+len(value))
+	binary.BigEndian.PutUint64(data[:8], revision)
+	binary.BigEndian.PutUint64(data[8:16], uint64(time.Time{}.Unix()))
+	binary.BigEndian.PutUint16(data[16:18], uint16(len(key)))
+	copy(data[20:], key)
+	copy(data[20+len(key):], value)
+	return data
+}
+
+// legacyPeer emulates a node, that only knows the command set from before the protocol has been
+// versioned. It answers ping with OK, stores a single container per key hash via cset, replies
+// the container of a key hash as bulk via cget and rejects all other commands.
+type legacyPeer struct {
+	containers map[string][]byte
+	received   chan []byte
+	mutex      sync.Mutex
+}
+
+func newLegacyPeer() *legacyPeer {
+	return &legacyPeer{
+		containers: make(map[string][]byte),
+		received:   make(chan []byte, 100),
+	}
+}
+
+func (p *legacyPeer) store(kh [8]byte, container []byte) {
+	p.mutex.Lock()
+	p.containers[string(kh[:])] = container
+	p.mutex.Unlock()
+}
+
+func (p *legacyPeer) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r, w := redisserver.NewReader(conn), redisserver.NewWriter(conn)
+			for {
+				command, err := r.ReadCommand()
+				if err != nil {
+					return
+				}
+				switch name := strings.ToLower(string(command.Args[0])); {
+				case name == "ping":
+					w.WriteString("OK")
+				case name == "cset" && len(command.Args) == 3:
+					p.mutex.Lock()
+					p.containers[string(command.Args[1])] = command.Args[2]
+					p.mutex.Unlock()
+					p.received <- command.Args[2]
+					w.WriteString("OK")
+				case name == "cget" && len(command.Args) == 2:
+					p.mutex.Lock()
+					container := p.containers[string(command.Args[1])]
+					p.mutex.Unlock()
+					w.WriteBulk(container)
+				default:
+					w.WriteError("unknown command [" + name + "]")
+				}
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
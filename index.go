@@ -0,0 +1,166 @@
+package deks
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+const (
+	indexMaxLevel    = 32
+	indexProbability = 0.25
+)
+
+// keyIndex holds keys in lexicographical order. It's implemented as a skip list, where the nodes
+// of the lowest level are linked in both directions to allow reverse iterations. The index is not
+// safe for concurrent use.
+type keyIndex struct {
+	head   *indexNode
+	tail   *indexNode
+	level  int
+	length int
+	random *rand.Rand
+}
+
+type indexNode struct {
+	key  []byte
+	next []*indexNode
+	prev *indexNode
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		head:   &indexNode{next: make([]*indexNode, indexMaxLevel)},
+		level:  1,
+		random: rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// insert adds the provided key to the index. If the key is already indexed, nothing happens.
+func (ki *keyIndex) insert(key []byte) {
+	update := make([]*indexNode, indexMaxLevel)
+	n := ki.head
+	for level := ki.level - 1; level >= 0; level-- {
+		for n.next[level] != nil && bytes.Compare(n.next[level].key, key) < 0 {
+			n = n.next[level]
+		}
+		update[level] = n
+	}
+	if next := n.next[0]; next != nil && bytes.Equal(next.key, key) {
+		return
+	}
+
+	level := ki.randomLevel()
+	if level > ki.level {
+		for l := ki.level; l < level; l++ {
+			update[l] = ki.head
+		}
+		ki.level = level
+	}
+	nn := &indexNode{key: key, next: make([]*indexNode, level)}
+	for l := 0; l < level; l++ {
+		nn.next[l] = update[l].next[l]
+		update[l].next[l] = nn
+	}
+	if update[0] != ki.head {
+		nn.prev = update[0]
+	}
+	if nn.next[0] != nil {
+		nn.next[0].prev = nn
+	} else {
+		ki.tail = nn
+	}
+	ki.length++
+}
+
+// remove deletes the provided key from the index. If the key isn't indexed, nothing happens.
+func (ki *keyIndex) remove(key []byte) {
+	update := make([]*indexNode, indexMaxLevel)
+	n := ki.head
+	for level := ki.level - 1; level >= 0; level-- {
+		for n.next[level] != nil && bytes.Compare(n.next[level].key, key) < 0 {
+			n = n.next[level]
+		}
+		update[level] = n
+	}
+	rn := n.next[0]
+	if rn == nil || !bytes.Equal(rn.key, key) {
+		return
+	}
+
+	for l := 0; l < len(rn.next); l++ {
+		update[l].next[l] = rn.next[l]
+	}
+	if rn.next[0] != nil {
+		rn.next[0].prev = rn.prev
+	} else {
+		ki.tail = rn.prev
+	}
+	for ki.level > 1 && ki.head.next[ki.level-1] == nil {
+		ki.level--
+	}
+	ki.length--
+}
+
+// ascend calls the provided function for all keys with start <= key < end in ascending order.
+// A nil start or end means no limit. If the function returns false, the iteration stops.
+func (ki *keyIndex) ascend(start, end []byte, fn func([]byte) bool) {
+	n := ki.head.next[0]
+	if start != nil {
+		n = ki.seek(start)
+	}
+	for ; n != nil && (end == nil || bytes.Compare(n.key, end) < 0); n = n.next[0] {
+		if !fn(n.key) {
+			return
+		}
+	}
+}
+
+// descend calls the provided function for all keys with start <= key < end in descending order.
+// A nil start or end means no limit. If the function returns false, the iteration stops.
+func (ki *keyIndex) descend(start, end []byte, fn func([]byte) bool) {
+	n := ki.tail
+	if end != nil {
+		if n = ki.seek(end); n != nil {
+			n = n.prev
+		} else {
+			n = ki.tail
+		}
+	}
+	for ; n != nil && (start == nil || bytes.Compare(n.key, start) >= 0); n = n.prev {
+		if !fn(n.key) {
+			return
+		}
+	}
+}
+
+// seek returns the first node with a key equal or greater than the provided key.
+func (ki *keyIndex) seek(key []byte) *indexNode {
+	n := ki.head
+	for level := ki.level - 1; level >= 0; level-- {
+		for n.next[level] != nil && bytes.Compare(n.next[level].key, key) < 0 {
+			n = n.next[level]
+		}
+	}
+	return n.next[0]
+}
+
+func (ki *keyIndex) randomLevel() int {
+	level := 1
+	for level < indexMaxLevel && ki.random.Float64() < indexProbability {
+		level++
+	}
+	return level
+}
+
+// prefixEnd returns the smallest key, that is greater than all keys with the provided prefix.
+// If no such key exists, nil is returned.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for index := len(end) - 1; index >= 0; index-- {
+		if end[index] < 0xff {
+			end[index]++
+			return end[:index+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package deks
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyIndexMatchesSortedKeys(t *testing.T) {
+	ki := newKeyIndex()
+	expected := map[string]bool{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%03d", rand.Intn(500))
+		if rand.Intn(3) == 0 {
+			ki.remove([]byte(key))
+			delete(expected, key)
+		} else {
+			ki.insert([]byte(key))
+			expected[key] = true
+		}
+	}
+	sorted := []string{}
+	for key := range expected {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	ascending := []string{}
+	ki.ascend(nil, nil, func(key []byte) bool { ascending = append(ascending, string(key)); return true })
+	assert.Equal(t, sorted, ascending)
+	assert.Equal(t, len(sorted), ki.length)
+
+	descending := []string{}
+	ki.descend(nil, nil, func(key []byte) bool { descending = append(descending, string(key)); return true })
+	for i, j := 0, len(descending)-1; i < j; i, j = i+1, j-1 {
+		descending[i], descending[j] = descending[j], descending[i]
+	}
+	assert.Equal(t, sorted, descending)
+}
+
+func TestKeyIndexRanges(t *testing.T) {
+	ki := newKeyIndex()
+	for _, key := range []string{"a", "b", "ba", "bb", "c"} {
+		ki.insert([]byte(key))
+	}
+
+	testFn := func(start, end []byte, reverse bool, expectKeys []string) func(*testing.T) {
+		return func(t *testing.T) {
+			keys := []string{}
+			fn := func(key []byte) bool { keys = append(keys, string(key)); return true }
+			if reverse {
+				ki.descend(start, end, fn)
+			} else {
+				ki.ascend(start, end, fn)
+			}
+			assert.Equal(t, expectKeys, keys)
+		}
+	}
+
+	t.Run("Ascend", testFn([]byte("b"), []byte("c"), false, []string{"b", "ba", "bb"}))
+	t.Run("AscendFromMissingKey", testFn([]byte("az"), nil, false, []string{"b", "ba", "bb", "c"}))
+	t.Run("Descend", testFn([]byte("b"), []byte("c"), true, []string{"bb", "ba", "b"}))
+	t.Run("DescendToMissingKey", testFn(nil, []byte("bab"), true, []string{"ba", "b", "a"}))
+	t.Run("Prefix", testFn([]byte("b"), prefixEnd([]byte("b")), false, []string{"b", "ba", "bb"}))
+	t.Run("Empty", testFn([]byte("d"), nil, true, []string{}))
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("b"), prefixEnd([]byte("a")))
+	assert.Equal(t, []byte("b"), prefixEnd([]byte("a\xff")))
+	assert.Nil(t, prefixEnd([]byte("\xff\xff")))
+	assert.Nil(t, prefixEnd(nil))
+}
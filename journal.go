@@ -0,0 +1,306 @@
+package deks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/simia-tech/errx"
+)
+
+const (
+	journalLogFileName          = "wal"
+	journalSnapshotFileName     = "snapshot"
+	journalSnapshotTempFileName = "snapshot.tmp"
+	journalNodeIDFileName       = "node_id"
+	journalNodeIDTempFileName   = "node_id.tmp"
+
+	journalHeaderSize = 8
+
+	journalOpSet    byte = 1
+	journalOpRemove byte = 2
+	journalOpBatch  byte = 3
+)
+
+// journal implements a write-ahead log with compacted snapshots. Each record is framed by
+// a 4-byte payload length and a 4-byte crc32 checksum of the payload. The payload consists
+// of an operation byte, the key hash and (for set operations) the marshaled container. A batch
+// record carries a zero key hash followed by the framed records of the batch, so the batch is
+// replayed all or not at all. If sync is enabled, each record is synced to disk before the write
+// is acknowledged. Records are written at the offset behind the last complete record, so the tail
+// of a failed write is overwritten or truncated. If the tail can't be truncated, the journal is
+// marked as failed and rejects all further writes.
+type journal struct {
+	dataDir string
+	file    *os.File
+	offset  int64
+	failed  error
+	sync    bool
+}
+
+func openJournal(dataDir string) (*journal, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, errx.Annotatef(err, "make dir [%s]", dataDir)
+	}
+	return &journal{dataDir: dataDir, sync: true}, nil
+}
+
+// nodeID returns the node id, that is stored in the data directory. If no node id has been
+// stored yet, a new one is generated and stored.
+func (j *journal) nodeID() (nodeID, error) {
+	path := filepath.Join(j.dataDir, journalNodeIDFileName)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		data = bytes.TrimSpace(data)
+		id := nodeID{}
+		if len(data) != 2*nodeIDSize {
+			return nodeID{}, errx.BadRequestf("invalid node id in [%s]", path)
+		}
+		if _, err := hex.Decode(id[:], data); err != nil {
+			return nodeID{}, errx.BadRequestf("invalid node id in [%s]: %v", path, err)
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return nodeID{}, errx.Annotatef(err, "read [%s]", path)
+	}
+
+	id := newNodeID()
+	tempPath := filepath.Join(j.dataDir, journalNodeIDTempFileName)
+	if err := ioutil.WriteFile(tempPath, []byte(id.String()), 0644); err != nil {
+		return nodeID{}, errx.Annotatef(err, "write [%s]", tempPath)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return nodeID{}, errx.Annotatef(err, "rename [%s] to [%s]", tempPath, path)
+	}
+	if err := syncDir(j.dataDir); err != nil {
+		return nodeID{}, err
+	}
+	return id, nil
+}
+
+// replay calls the provided function for every record in the snapshot and the write-ahead
+// log. A corrupted or incomplete tail of the write-ahead log is truncated. Afterwards, the
+// write-ahead log is opened for appending.
+func (j *journal) replay(fn func(byte, keyHash, []byte) error) error {
+	snapshotPath := filepath.Join(j.dataDir, journalSnapshotFileName)
+	if _, err := replayFile(snapshotPath, fn); err != nil && !os.IsNotExist(errx.Cause(err)) {
+		return errx.Annotatef(err, "replay snapshot")
+	}
+
+	logPath := filepath.Join(j.dataDir, journalLogFileName)
+	offset, err := replayFile(logPath, fn)
+	if err != nil && !os.IsNotExist(errx.Cause(err)) {
+		return errx.Annotatef(err, "replay log")
+	}
+
+	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errx.Annotatef(err, "open [%s]", logPath)
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return errx.Annotatef(err, "truncate [%s]", logPath)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return errx.Annotatef(err, "seek [%s]", logPath)
+	}
+	j.file = file
+	j.offset = offset
+	return nil
+}
+
+// append writes a record to the write-ahead log.
+func (j *journal) append(op byte, kh keyHash, data []byte) error {
+	return j.write(journalRecord(op, kh, data))
+}
+
+// appendBatch writes the provided framed records as a single batch record to the write-ahead log.
+func (j *journal) appendBatch(records [][]byte) error {
+	data := []byte{}
+	for _, record := range records {
+		data = append(data, record...)
+	}
+	return j.write(journalRecord(journalOpBatch, keyHash{}, data))
+}
+
+// write writes the provided record behind the last complete record and syncs it to disk, if sync
+// is enabled. If that fails, the write-ahead log is truncated back to the last complete record.
+func (j *journal) write(record []byte) error {
+	if j.failed != nil {
+		return errx.Annotatef(j.failed, "journal failed")
+	}
+	if _, err := j.file.WriteAt(record, j.offset); err != nil {
+		return j.rollback(errx.Annotatef(err, "write record"))
+	}
+	if j.sync {
+		if err := j.file.Sync(); err != nil {
+			return j.rollback(errx.Annotatef(err, "sync"))
+		}
+	}
+	j.offset += int64(len(record))
+	return nil
+}
+
+// rollback truncates the write-ahead log to the last complete record and returns the provided
+// error. If the truncation fails, the journal is marked as failed.
+func (j *journal) rollback(err error) error {
+	if truncateErr := j.file.Truncate(j.offset); truncateErr != nil {
+		j.failed = errx.Annotatef(truncateErr, "truncate log")
+	}
+	return err
+}
+
+// snapshot writes all records emitted by the provided function into a new snapshot and
+// truncates the write-ahead log afterwards.
+func (j *journal) snapshot(fn func(func(keyHash, []byte) error) error) error {
+	tempPath := filepath.Join(j.dataDir, journalSnapshotTempFileName)
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errx.Annotatef(err, "open [%s]", tempPath)
+	}
+	w := bufio.NewWriter(file)
+	if err := fn(func(kh keyHash, data []byte) error {
+		_, err := w.Write(journalRecord(journalOpSet, kh, data))
+		return err
+	}); err != nil {
+		file.Close()
+		return errx.Annotatef(err, "write snapshot")
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return errx.Annotatef(err, "flush")
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errx.Annotatef(err, "sync")
+	}
+	if err := file.Close(); err != nil {
+		return errx.Annotatef(err, "close [%s]", tempPath)
+	}
+
+	snapshotPath := filepath.Join(j.dataDir, journalSnapshotFileName)
+	if err := os.Rename(tempPath, snapshotPath); err != nil {
+		return errx.Annotatef(err, "rename [%s] to [%s]", tempPath, snapshotPath)
+	}
+	if err := syncDir(j.dataDir); err != nil {
+		return err
+	}
+
+	if err := j.file.Truncate(0); err != nil {
+		return errx.Annotatef(err, "truncate log")
+	}
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return errx.Annotatef(err, "seek log")
+	}
+	j.offset = 0
+	return nil
+}
+
+func (j *journal) close() error {
+	if j.file == nil {
+		return nil
+	}
+	if err := j.file.Sync(); err != nil {
+		return errx.Annotatef(err, "sync")
+	}
+	return j.file.Close()
+}
+
+// syncDir syncs the directory at the provided path to disk, so a preceding rename is durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return errx.Annotatef(err, "open [%s]", path)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return errx.Annotatef(err, "sync [%s]", path)
+	}
+	return nil
+}
+
+// replayFile reads all valid records of the file at the provided path and returns the
+// offset behind the last valid record.
+func replayFile(path string, fn func(byte, keyHash, []byte) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, errx.Annotatef(err, "open [%s]", path)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	offset := int64(0)
+	header := make([]byte, journalHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			log.Printf("journal [%s]: incomplete record header at offset %d", path, offset)
+			return offset, nil
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		checksum := binary.BigEndian.Uint32(header[4:])
+		if length < 1+keyHashSize {
+			log.Printf("journal [%s]: invalid record length %d at offset %d", path, length, offset)
+			return offset, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			log.Printf("journal [%s]: incomplete record at offset %d", path, offset)
+			return offset, nil
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			log.Printf("journal [%s]: checksum mismatch at offset %d", path, offset)
+			return offset, nil
+		}
+		if err := applyRecord(payload, fn); err != nil {
+			return offset, errx.Annotatef(err, "apply record at offset %d", offset)
+		}
+		offset += journalHeaderSize + int64(length)
+	}
+}
+
+// applyRecord calls the provided function with the operation, key hash and data of the provided
+// payload. The records of a batch are passed one by one.
+func applyRecord(payload []byte, fn func(byte, keyHash, []byte) error) error {
+	if payload[0] != journalOpBatch {
+		return fn(payload[0], newKeyHash(payload[1:]), payload[1+keyHashSize:])
+	}
+	data := payload[1+keyHashSize:]
+	for len(data) > 0 {
+		if len(data) < journalHeaderSize {
+			return errx.BadRequestf("incomplete batch record header")
+		}
+		length := int(binary.BigEndian.Uint32(data[:4]))
+		if length < 1+keyHashSize || len(data) < journalHeaderSize+length {
+			return errx.BadRequestf("invalid batch record length %d", length)
+		}
+		if err := applyRecord(data[journalHeaderSize:journalHeaderSize+length], fn); err != nil {
+			return err
+		}
+		data = data[journalHeaderSize+length:]
+	}
+	return nil
+}
+
+func journalRecord(op byte, kh keyHash, data []byte) []byte {
+	length := 1 + keyHashSize + len(data)
+	record := make([]byte, journalHeaderSize+length)
+	payload := record[journalHeaderSize:]
+	payload[0] = op
+	copy(payload[1:], kh[:])
+	copy(payload[1+keyHashSize:], data)
+	binary.BigEndian.PutUint32(record[:4], uint32(length))
+	binary.BigEndian.PutUint32(record[4:journalHeaderSize], crc32.ChecksumIEEE(payload))
+	return record
+}
@@ -0,0 +1,428 @@
+package deks
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/simia-tech/errx"
+)
+
+// MemberState defines the state of a cluster member.
+type MemberState int
+
+const (
+	// MemberAlive marks a member that responds to probes.
+	MemberAlive MemberState = iota
+
+	// MemberSuspect marks a member that failed to respond to a probe. If it doesn't refute the
+	// suspicion within the suspect timeout, it's declared dead.
+	MemberSuspect
+
+	// MemberDead marks a member that has been removed from the cluster.
+	MemberDead
+)
+
+const (
+	// DefaultProbeTimeout defines the default duration, a member has to respond to a probe.
+	DefaultProbeTimeout = 500 * time.Millisecond
+	// DefaultSuspectTimeout defines the default duration, after which a suspected member is
+	// declared dead.
+	DefaultSuspectTimeout = 5 * time.Second
+
+	indirectProbeCount  = 3
+	deadRetentionFactor = 10
+)
+
+func (ms MemberState) String() string {
+	switch ms {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+func parseMemberState(s string) (MemberState, error) {
+	switch s {
+	case "alive":
+		return MemberAlive, nil
+	case "suspect":
+		return MemberSuspect, nil
+	case "dead":
+		return MemberDead, nil
+	}
+	return 0, errx.BadRequestf("invalid member state [%s]", s)
+}
+
+// Member defines a member of the cluster.
+type Member struct {
+	URL         string
+	State       MemberState
+	Incarnation uint64
+}
+
+// overrides returns true, if the provided member information supersedes the receiver's one. The
+// rules follow the SWIM protocol.
+func (m Member) overrides(o Member) bool {
+	switch m.State {
+	case MemberAlive:
+		return m.Incarnation > o.Incarnation
+	case MemberSuspect:
+		if o.State == MemberAlive {
+			return m.Incarnation >= o.Incarnation
+		}
+		return m.Incarnation > o.Incarnation
+	case MemberDead:
+		if o.State == MemberDead {
+			return false
+		}
+		return m.Incarnation >= o.Incarnation
+	}
+	return false
+}
+
+type member struct {
+	Member
+	changedAt time.Time
+}
+
+// membership holds the members of the cluster, as seen by this node. The members are exchanged
+// with every probe, so all nodes converge to the same view.
+type membership struct {
+	self           Member
+	members        map[string]*member
+	probeTimeout   time.Duration
+	suspectTimeout time.Duration
+	mutex          sync.RWMutex
+}
+
+func newMembership(selfURL string) *membership {
+	return &membership{
+		self:           Member{URL: selfURL, State: MemberAlive},
+		members:        make(map[string]*member),
+		probeTimeout:   DefaultProbeTimeout,
+		suspectTimeout: DefaultSuspectTimeout,
+	}
+}
+
+// list returns all members including this node and the dead members.
+func (ms *membership) list() []Member {
+	ms.mutex.RLock()
+	result := make([]Member, 0, len(ms.members)+1)
+	result = append(result, ms.self)
+	for _, m := range ms.members {
+		result = append(result, m.Member)
+	}
+	ms.mutex.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].URL < result[j].URL })
+	return result
+}
+
+// merge applies the provided member information and returns the urls of the members that have
+// joined or left the cluster.
+func (ms *membership) merge(updates []Member) ([]string, []string) {
+	joined, left := []string{}, []string{}
+	now := time.Now()
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for _, u := range updates {
+		if u.URL == ms.self.URL {
+			// Suspicions about this node are refuted with a higher incarnation.
+			if u.State != MemberAlive && u.Incarnation >= ms.self.Incarnation {
+				ms.self.Incarnation = u.Incarnation + 1
+			}
+			continue
+		}
+		m, ok := ms.members[u.URL]
+		if !ok {
+			ms.members[u.URL] = &member{Member: u, changedAt: now}
+			if u.State != MemberDead {
+				joined = append(joined, u.URL)
+			}
+			continue
+		}
+		if !u.overrides(m.Member) {
+			continue
+		}
+		switch {
+		case m.State == MemberDead && u.State != MemberDead:
+			joined = append(joined, u.URL)
+		case m.State != MemberDead && u.State == MemberDead:
+			left = append(left, u.URL)
+		}
+		if m.State != u.State {
+			m.changedAt = now
+		}
+		m.Member = u
+	}
+	return joined, left
+}
+
+// urls returns the urls of all members, that are not dead.
+func (ms *membership) urls() []string {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	urls := []string{}
+	for url, m := range ms.members {
+		if m.State != MemberDead {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// suspect marks the member with the provided url as suspect.
+func (ms *membership) suspect(url string) {
+	ms.mutex.Lock()
+	if m, ok := ms.members[url]; ok && m.State == MemberAlive {
+		m.State = MemberSuspect
+		m.changedAt = time.Now()
+	}
+	ms.mutex.Unlock()
+}
+
+// expire declares all members dead, that have been suspected longer than the suspect timeout.
+// Dead members are kept for a while, so they're not brought back by outdated information of
+// other members. The urls of the members that have left the cluster, are returned.
+func (ms *membership) expire() []string {
+	left := []string{}
+	now := time.Now()
+	ms.mutex.Lock()
+	for url, m := range ms.members {
+		switch {
+		case m.State == MemberSuspect && now.Sub(m.changedAt) > ms.suspectTimeout:
+			m.State = MemberDead
+			m.changedAt = now
+			left = append(left, url)
+		case m.State == MemberDead && now.Sub(m.changedAt) > deadRetentionFactor*ms.suspectTimeout:
+			delete(ms.members, url)
+		}
+	}
+	ms.mutex.Unlock()
+	return left
+}
+
+// targets returns the urls of up to count randomly chosen members, that are not dead and
+// not excluded.
+func (ms *membership) targets(count int, exclude string) []string {
+	ms.mutex.RLock()
+	urls := []string{}
+	for url, m := range ms.members {
+		if m.State != MemberDead && url != exclude {
+			urls = append(urls, url)
+		}
+	}
+	ms.mutex.RUnlock()
+	sort.Strings(urls)
+	rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+	if count < len(urls) {
+		urls = urls[:count]
+	}
+	return urls
+}
+
+func memberArguments(members []Member) []interface{} {
+	arguments := make([]interface{}, 0, 3*len(members))
+	for _, m := range members {
+		arguments = append(arguments, m.URL, m.State.String(), strconv.FormatUint(m.Incarnation, 10))
+	}
+	return arguments
+}
+
+func parseMemberArguments(arguments [][]byte) ([]Member, error) {
+	if len(arguments)%3 != 0 {
+		return nil, errx.BadRequestf("expected triples of url, state and incarnation, got %d arguments", len(arguments))
+	}
+	members := make([]Member, len(arguments)/3)
+	for index := range members {
+		state, err := parseMemberState(string(arguments[3*index+1]))
+		if err != nil {
+			return nil, errx.Annotatef(err, "parse member state")
+		}
+		incarnation, err := strconv.ParseUint(string(arguments[3*index+2]), 10, 64)
+		if err != nil {
+			return nil, errx.Annotatef(err, "parse incarnation [%s]", arguments[3*index+2])
+		}
+		members[index] = Member{
+			URL:         string(arguments[3*index]),
+			State:       state,
+			Incarnation: incarnation,
+		}
+	}
+	return members, nil
+}
+
+func parseMemberResponse(response *redis.Resp) ([]Member, error) {
+	items, err := response.Array()
+	if err != nil {
+		return nil, errx.Annotatef(err, "response array")
+	}
+	arguments := make([][]byte, len(items))
+	for index, item := range items {
+		if arguments[index], err = item.Bytes(); err != nil {
+			return nil, errx.Annotatef(err, "response bytes")
+		}
+	}
+	return parseMemberArguments(arguments)
+}
+
+// SetMembership configures and enables the cluster membership. Until the membership is enabled,
+// member pings of other nodes are rejected. The advertise url is announced to the other
+// members, if empty, the listen url is used. A member that doesn't respond within the probe
+// timeout is suspected and declared dead after the suspect timeout. The ping and reconnect
+// intervals are used for the peers, that are added for discovered members.
+func (s *Server) SetMembership(
+	advertiseURL string,
+	probeTimeout time.Duration,
+	suspectTimeout time.Duration,
+	peerPingInterval time.Duration,
+	peerReconnectInterval time.Duration,
+) {
+	if advertiseURL == "" {
+		advertiseURL = s.ListenURL()
+	}
+	s.membership.mutex.Lock()
+	s.membership.self.URL = advertiseURL
+	s.membership.probeTimeout = probeTimeout
+	s.membership.suspectTimeout = suspectTimeout
+	s.membership.mutex.Unlock()
+
+	s.memberMutex.Lock()
+	s.memberPeerPingInterval = peerPingInterval
+	s.memberPeerReconnectInterval = peerReconnectInterval
+	s.memberEnabled = true
+	s.memberMutex.Unlock()
+}
+
+// membershipEnabled returns true, if the membership has been enabled by SetMembership or Join.
+func (s *Server) membershipEnabled() bool {
+	s.memberMutex.Lock()
+	defer s.memberMutex.Unlock()
+	return s.memberEnabled
+}
+
+// Members returns all members of the cluster including this node.
+func (s *Server) Members() []Member {
+	return s.membership.list()
+}
+
+// Join announces this node to the member at the provided url and fetches the members it knows.
+// All discovered members are added as peers. The membership is enabled, if it isn't already.
+func (s *Server) Join(url string) error {
+	s.memberMutex.Lock()
+	s.memberEnabled = true
+	s.memberMutex.Unlock()
+
+	if err := s.probe(url); err != nil {
+		return errx.Annotatef(err, "probe [%s]", url)
+	}
+	return nil
+}
+
+// Probe performs a single protocol period of the failure detection. A random member is probed
+// directly and, if that fails, indirectly via other members. If all probes fail, the member is
+// suspected. Suspected members, that haven't refuted the suspicion in time, are removed.
+func (s *Server) Probe() {
+	for _, url := range s.membership.expire() {
+		s.removeMember(url)
+	}
+
+	targets := s.membership.targets(1, "")
+	if len(targets) == 0 {
+		return
+	}
+	target := targets[0]
+	if err := s.probe(target); err == nil {
+		return
+	}
+	for _, url := range s.membership.targets(indirectProbeCount, target) {
+		if ok, err := s.probeIndirect(url, target); err == nil && ok {
+			return
+		}
+	}
+	s.membership.suspect(target)
+}
+
+// probe exchanges the member lists with the member at the provided url.
+func (s *Server) probe(url string) error {
+	conn, _, err := s.dialPeer(url, s.probeTimeout())
+	if err != nil {
+		return errx.Annotatef(err, "dial peer [%s]", url)
+	}
+	defer conn.Close()
+
+	members, err := conn.memberPing(s.membership.list())
+	if err != nil {
+		return errx.Annotatef(err, "member ping")
+	}
+	s.applyMembers(members)
+	return nil
+}
+
+// probeIndirect requests the member at the provided url to probe the target.
+func (s *Server) probeIndirect(url, target string) (bool, error) {
+	conn, _, err := s.dialPeer(url, 2*s.probeTimeout())
+	if err != nil {
+		return false, errx.Annotatef(err, "dial peer [%s]", url)
+	}
+	defer conn.Close()
+
+	return conn.memberPingRequest(target, s.membership.list())
+}
+
+func (s *Server) probeTimeout() time.Duration {
+	s.membership.mutex.RLock()
+	defer s.membership.mutex.RUnlock()
+	return s.membership.probeTimeout
+}
+
+func (s *Server) applyMembers(members []Member) {
+	joined, left := s.membership.merge(members)
+	for _, url := range joined {
+		s.addMember(url)
+	}
+	for _, url := range left {
+		s.removeMember(url)
+	}
+}
+
+// addMember adds a peer for the member at the provided url and reconciles with it. Members that
+// are already peers, are left untouched.
+func (s *Server) addMember(url string) {
+	s.memberMutex.Lock()
+	defer s.memberMutex.Unlock()
+	if err := s.AddPeer(url, s.memberPeerPingInterval, s.memberPeerReconnectInterval); err != nil {
+		if !errx.IsAlreadyExists(err) {
+			log.Printf("member [%s]: add peer: %v", url, err)
+		}
+		return
+	}
+	s.memberPeers[url] = struct{}{}
+	go func() {
+		if _, _, err := s.ReconcilateBidirectional(url); err != nil {
+			log.Printf("member [%s]: reconcilate: %v", url, err)
+		}
+	}()
+}
+
+// removeMember removes the peer of the member at the provided url, if it has been added by the
+// membership.
+func (s *Server) removeMember(url string) {
+	s.memberMutex.Lock()
+	defer s.memberMutex.Unlock()
+	if _, ok := s.memberPeers[url]; !ok {
+		return
+	}
+	delete(s.memberPeers, url)
+	if err := s.RemovePeer(url); err != nil {
+		log.Printf("member [%s]: remove peer: %v", url, err)
+	}
+}
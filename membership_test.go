@@ -0,0 +1,105 @@
+package deks_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simia-tech/deks"
+)
+
+func TestServerJoinDiscoversMembers(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverOne.SetMembership("", deks.DefaultProbeTimeout, deks.DefaultSuspectTimeout, time.Minute, time.Minute)
+
+	storeThree := deks.NewStore(e.metric)
+	serverThree, err := deks.NewServer(storeThree, "tcp://localhost:0", e.metric)
+	require.NoError(t, err)
+	defer serverThree.Close()
+
+	require.NoError(t, e.serverTwo.Join(e.serverOne.ListenURL()))
+	require.NoError(t, serverThree.Join(e.serverOne.ListenURL()))
+	e.serverTwo.Probe()
+
+	for _, server := range []*deks.Server{e.serverOne, e.serverTwo, serverThree} {
+		members := server.Members()
+		require.Len(t, members, 3)
+		for _, member := range members {
+			assert.Equal(t, deks.MemberAlive, member.State)
+		}
+		assert.Len(t, server.PeerURLs(), 2)
+	}
+}
+
+func TestServerJoinReplicatesToDiscoveredMembers(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverOne.SetMembership("", deks.DefaultProbeTimeout, deks.DefaultSuspectTimeout, time.Minute, time.Minute)
+
+	require.NoError(t, e.serverTwo.Join(e.serverOne.ListenURL()))
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	time.Sleep(100 * time.Millisecond)
+
+	value, err := e.storeTwo.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+}
+
+func TestServerTidyKeepsTombstonesWhileMemberIsNoPeer(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverOne.SetMembership("", deks.DefaultProbeTimeout, deks.DefaultSuspectTimeout, time.Minute, time.Minute)
+	e.serverTwo.SetMembership("", deks.DefaultProbeTimeout, deks.DefaultSuspectTimeout, time.Minute, time.Minute)
+	require.NoError(t, e.serverOne.Join(e.serverTwo.ListenURL()))
+	require.NoError(t, e.serverOne.RemovePeer(e.serverTwo.ListenURL()))
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeOne.Delete(testKey))
+	require.NoError(t, e.storeOne.Tidy())
+
+	assert.Equal(t, 1, e.storeOne.DeletedLen())
+}
+
+func TestServerRejectsMemberPingWithoutMembership(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	assert.Error(t, e.serverTwo.Join(e.serverOne.ListenURL()))
+	assert.Empty(t, e.serverOne.PeerURLs())
+	assert.Len(t, e.serverOne.Members(), 1)
+}
+
+func TestServerProbeRemovesDeadMembers(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverOne.SetMembership("", 50*time.Millisecond, 100*time.Millisecond, time.Minute, time.Minute)
+
+	storeThree := deks.NewStore(e.metric)
+	serverThree, err := deks.NewServer(storeThree, "tcp://localhost:0", e.metric)
+	require.NoError(t, err)
+
+	require.NoError(t, serverThree.Join(e.serverOne.ListenURL()))
+	require.Len(t, e.serverOne.PeerURLs(), 1)
+	require.NoError(t, serverThree.Close())
+
+	e.serverOne.Probe()
+	members := e.serverOne.Members()
+	require.Len(t, members, 2)
+	assert.Contains(t, members, deks.Member{URL: serverThree.ListenURL(), State: deks.MemberSuspect})
+
+	time.Sleep(150 * time.Millisecond)
+	e.serverOne.Probe()
+	members = e.serverOne.Members()
+	require.Len(t, members, 2)
+	assert.Contains(t, members, deks.Member{URL: serverThree.ListenURL(), State: deks.MemberDead})
+	assert.Empty(t, e.serverOne.PeerURLs())
+}
@@ -7,4 +7,8 @@ type Metric interface {
 	ClientDisconnected(string)
 	PeerConnected(string)
 	PeerDisconnected(string)
+	Tidied(int, int, int)
+	Reconcilated(string, int)
+	PeerQueueChanged(string, int)
+	PeerUpdatesDropped(string, int)
 }
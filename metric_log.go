@@ -1,9 +1,21 @@
 package deks
 
-import "log"
+import (
+	"log"
+	"sync"
+)
+
+// peerQueueLogThreshold defines the depth of a peer's queue, above which the queue is reported as
+// backlogged.
+const peerQueueLogThreshold = 128
 
 // MetricLog defines a metric log.
-type MetricLog struct{}
+type MetricLog struct {
+	backlogged      map[string]bool
+	backloggedMutex sync.Mutex
+	kept            [2]int
+	keptMutex       sync.Mutex
+}
 
 // NewMetricLog returns a new metric log.
 func NewMetricLog() *MetricLog {
@@ -34,3 +46,47 @@ func (ml *MetricLog) PeerConnected(peerURL string) {
 func (ml *MetricLog) PeerDisconnected(peerURL string) {
 	log.Printf("peer [%s] disconnected", peerURL)
 }
+
+// Tidied is called after the store has been cleaned up. The number of purged deleted values is
+// provided as well as the number of deleted values, that have been kept because they are still in
+// their grace period or haven't been acknowledged by all peers. Since it's called periodically,
+// it's only logged, if values have been purged or the numbers of kept values have changed.
+func (ml *MetricLog) Tidied(purgedCount, graceCount, unacknowledgedCount int) {
+	ml.keptMutex.Lock()
+	defer ml.keptMutex.Unlock()
+	kept := [2]int{graceCount, unacknowledgedCount}
+	if purgedCount == 0 && kept == ml.kept {
+		return
+	}
+	ml.kept = kept
+	log.Printf("tidied: purged = %d / in grace period = %d / unacknowledged = %d", purgedCount, graceCount, unacknowledgedCount)
+}
+
+// Reconcilated is called after a reconciliation with a peer. The number of repaired keys is provided.
+func (ml *MetricLog) Reconcilated(peerURL string, repairedCount int) {
+	log.Printf("reconcilated with peer [%s]: repaired = %d", peerURL, repairedCount)
+}
+
+// PeerQueueChanged is called if the number of queued updates for a peer has changed. Since it's
+// called for every update, only the crossing of a threshold is logged.
+func (ml *MetricLog) PeerQueueChanged(peerURL string, depth int) {
+	ml.backloggedMutex.Lock()
+	defer ml.backloggedMutex.Unlock()
+	switch {
+	case depth >= peerQueueLogThreshold && !ml.backlogged[peerURL]:
+		if ml.backlogged == nil {
+			ml.backlogged = make(map[string]bool)
+		}
+		ml.backlogged[peerURL] = true
+		log.Printf("peer [%s] queue backlogged: depth = %d", peerURL, depth)
+	case depth == 0 && ml.backlogged[peerURL]:
+		delete(ml.backlogged, peerURL)
+		log.Printf("peer [%s] queue drained", peerURL)
+	}
+}
+
+// PeerUpdatesDropped is called if an update for a peer has been dropped, because the peer's
+// queue was full. The total number of dropped updates is provided.
+func (ml *MetricLog) PeerUpdatesDropped(peerURL string, dropCount int) {
+	log.Printf("peer [%s] dropped update: total dropped = %d", peerURL, dropCount)
+}
@@ -22,3 +22,15 @@ func (mm *MetricMock) PeerConnected(_ string) {}
 
 // PeerDisconnected is called if a peer disconnects.
 func (mm *MetricMock) PeerDisconnected(_ string) {}
+
+// Tidied is called after the store has been cleaned up.
+func (mm *MetricMock) Tidied(_, _, _ int) {}
+
+// Reconcilated is called after a reconciliation with a peer.
+func (mm *MetricMock) Reconcilated(_ string, _ int) {}
+
+// PeerQueueChanged is called if the number of queued updates for a peer has changed.
+func (mm *MetricMock) PeerQueueChanged(_ string, _ int) {}
+
+// PeerUpdatesDropped is called if an update for a peer has been dropped.
+func (mm *MetricMock) PeerUpdatesDropped(_ string, _ int) {}
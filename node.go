@@ -2,7 +2,9 @@ package deks
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/simia-tech/errx"
@@ -13,46 +15,171 @@ type Node struct {
 	Store  *Store
 	server *Server
 	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 // NewNode returns a new node.
 func NewNode(o Options, m Metric) (*Node, error) {
 	store := NewStore(m)
-	server, err := NewServer(store, o.ListenURL, m)
+	if o.DataDir != "" {
+		var err error
+		store, err = OpenStore(o.DataDir, m)
+		if err != nil {
+			return nil, errx.Annotatef(err, "open store [%s]", o.DataDir)
+		}
+		store.SetSync(!o.DisableSync)
+	}
+	store.SetTombstoneGracePeriod(o.TombstoneGracePeriod)
+	var tlsConfig *tls.Config
+	if o.TLSCertFile != "" || o.TLSKeyFile != "" || o.TLSCAFile != "" {
+		var err error
+		tlsConfig, err = NewTLSConfig(o.TLSCertFile, o.TLSKeyFile, o.TLSCAFile, o.TLSVerifyClients)
+		if err != nil {
+			store.Close()
+			return nil, errx.Annotatef(err, "new tls config")
+		}
+	}
+	server, err := NewServerWithTLS(store, o.ListenURL, tlsConfig, m)
 	if err != nil {
+		store.Close()
 		return nil, errx.Annotatef(err, "new server")
 	}
+	batchSize, parallelism := o.ReconcileBatchSize, o.ReconcileParallelism
+	if batchSize == 0 {
+		batchSize = DefaultReconcileBatchSize
+	}
+	if parallelism == 0 {
+		parallelism = DefaultReconcileParallelism
+	}
+	server.SetReconcileBatching(batchSize, parallelism)
+	queueSize := o.PeerQueueSize
+	if queueSize == 0 {
+		queueSize = DefaultPeerQueueSize
+	}
+	server.SetPeerQueue(queueSize, o.PeerQueueOverflowPolicy, o.PeerQueueTimeout)
+	peerBatchSize := o.PeerBatchSize
+	if peerBatchSize == 0 {
+		peerBatchSize = DefaultPeerBatchSize
+	}
+	server.SetPeerBatching(peerBatchSize, o.PeerBatchLinger)
+	server.SetRelayHops(o.RelayHops)
+	server.SetMessageForwarding(o.ForwardMessages)
+	if o.ClusterName != "" {
+		server.SetClusterName(o.ClusterName)
+	}
+	server.SetUsers(o.Users)
+	server.SetPeerCredentials(o.PeerUser, o.PeerPassword)
+	if o.ProbeInterval > 0 {
+		probeTimeout, suspectTimeout := o.ProbeTimeout, o.SuspectTimeout
+		if probeTimeout == 0 {
+			probeTimeout = DefaultProbeTimeout
+		}
+		if suspectTimeout == 0 {
+			suspectTimeout = DefaultSuspectTimeout
+		}
+		server.SetMembership(o.AdvertiseURL, probeTimeout, suspectTimeout, o.PeerPingInterval, o.PeerReconnectInterval)
+	}
 	for _, peerURL := range o.PeerURLs {
-		_, err := server.Reconcilate(peerURL)
+		_, _, err := server.ReconcilateBidirectional(peerURL)
 		if err != nil {
 			log.Printf("reconsilate: %v", err)
 		}
 		if err := server.AddPeer(peerURL, o.PeerPingInterval, o.PeerReconnectInterval); err != nil {
+			server.Close()
+			store.Close()
 			return nil, errx.Annotatef(err, "peer add")
 		}
 	}
 
+	if o.ProbeInterval > 0 {
+		for _, joinURL := range o.JoinURLs {
+			if err := server.Join(joinURL); err != nil {
+				log.Printf("join: %v", err)
+			}
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
+	n := &Node{
+		Store:  store,
+		server: server,
+		cancel: cancel,
+	}
+
+	n.wg.Add(1)
 	go func() {
+		defer n.wg.Done()
 		ticker := time.NewTicker(o.TidyInterval)
+		defer ticker.Stop()
+		var expireC <-chan time.Time
+		if o.ExpireInterval > 0 {
+			expireTicker := time.NewTicker(o.ExpireInterval)
+			defer expireTicker.Stop()
+			expireC = expireTicker.C
+		}
+		var snapshotC <-chan time.Time
+		if o.DataDir != "" && o.SnapshotInterval > 0 {
+			snapshotTicker := time.NewTicker(o.SnapshotInterval)
+			defer snapshotTicker.Stop()
+			snapshotC = snapshotTicker.C
+		}
 		for {
 			select {
 			case <-ctx.Done():
-				ticker.Stop()
 				return
 			case <-ticker.C:
 				if err := store.Tidy(); err != nil {
 					log.Printf("tidy: %v", err)
 				}
+			case <-expireC:
+				if err := store.Sweep(); err != nil {
+					log.Printf("sweep: %v", err)
+				}
+			case <-snapshotC:
+				if err := store.Snapshot(); err != nil {
+					log.Printf("snapshot: %v", err)
+				}
 			}
 		}
 	}()
 
-	return &Node{
-		Store:  store,
-		server: server,
-		cancel: cancel,
-	}, nil
+	if o.ReconcileInterval > 0 {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			ticker := time.NewTicker(o.ReconcileInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if _, err := server.ReconcilatePeers(o.ReconcilePeerCount); err != nil {
+						log.Printf("anti-entropy: %v", err)
+					}
+				}
+			}
+		}()
+	}
+
+	if o.ProbeInterval > 0 {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			ticker := time.NewTicker(o.ProbeInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					server.Probe()
+				}
+			}
+		}()
+	}
+
+	return n, nil
 }
 
 // ListenURL returns the listen url.
@@ -63,5 +190,12 @@ func (n *Node) ListenURL() string {
 // Close tears down the node.
 func (n *Node) Close() error {
 	n.cancel()
-	return n.server.Close()
+	n.wg.Wait()
+	if err := n.server.Close(); err != nil {
+		return errx.Annotatef(err, "close server")
+	}
+	if err := n.Store.Close(); err != nil {
+		return errx.Annotatef(err, "close store")
+	}
+	return nil
 }
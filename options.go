@@ -4,18 +4,130 @@ import "time"
 
 // Options defines all deks options.
 type Options struct {
-	// Listener address in format 'tcp://localhost:5000'.
+	// Listener address in format 'tcp://localhost:5000' or 'tls://localhost:5000'.
 	ListenURL string
 
-	// Peer addreses in the format `tcp://localhost:5000`.
+	// Peer addreses in the format `tcp://localhost:5000` or 'tls://localhost:5000'.
 	PeerURLs []string
 
+	// TLSCertFile defines the path to the pem encoded certificate, that is used for the tls
+	// listener and as client certificate for connections to peers.
+	TLSCertFile string
+
+	// TLSKeyFile defines the path to the pem encoded key of the certificate.
+	TLSKeyFile string
+
+	// TLSCAFile defines the path to the pem encoded certificates, that are used to verify peers.
+	// If empty, the system's certificate pool is used.
+	TLSCAFile string
+
+	// TLSVerifyClients defines whether clients have to present a certificate, that has been
+	// signed by a certificate in TLSCAFile.
+	TLSVerifyClients bool
+
+	// Users defines the users, that can authenticate with the AUTH command. If empty, the
+	// authentication is disabled.
+	Users []User
+
+	// PeerUser and PeerPassword define the credentials, that are used to authenticate at the
+	// peers. If PeerPassword is empty, no authentication is performed.
+	PeerUser     string
+	PeerPassword string
+
+	// ClusterName defines the name of the cluster. Nodes only exchange data with nodes of the same
+	// cluster. If empty, DefaultClusterName is used.
+	ClusterName string
+
+	// AdvertiseURL defines the address in format 'tcp://localhost:5000', that is announced to other
+	// cluster members. If empty, the listener address is used.
+	AdvertiseURL string
+
+	// JoinURLs defines the addresses of cluster members in format 'tcp://localhost:5000', the node
+	// announces itself to at startup. All other members are discovered.
+	JoinURLs []string
+
+	// ProbeInterval defines the interval in which a random cluster member is probed. If zero, the
+	// membership is disabled.
+	ProbeInterval time.Duration
+
+	// ProbeTimeout defines the duration, a cluster member has to respond to a probe. If zero,
+	// DefaultProbeTimeout is used.
+	ProbeTimeout time.Duration
+
+	// SuspectTimeout defines the duration, after which a cluster member, that failed to respond
+	// to probes, is removed. If zero, DefaultSuspectTimeout is used.
+	SuspectTimeout time.Duration
+
 	// PeerPingInterval defines the interval in which a peer is pinged in order to test it's availbility.
 	PeerPingInterval time.Duration
 
 	// PeerReconnectInterval defines a duration after which a failing peer is reconnected.
 	PeerReconnectInterval time.Duration
 
+	// PeerQueueSize defines the number of updates, that are queued for each peer. If zero,
+	// DefaultPeerQueueSize is used.
+	PeerQueueSize int
+
+	// PeerQueueOverflowPolicy defines what happens to an update, if a peer's queue is full.
+	PeerQueueOverflowPolicy OverflowPolicy
+
+	// PeerQueueTimeout defines how long a write blocks on a full queue, if the overflow policy is
+	// OverflowBlock.
+	PeerQueueTimeout time.Duration
+
+	// PeerBatchSize defines the number of bytes, that are collected before a batch of updates is
+	// sent to a peer. If zero, DefaultPeerBatchSize is used.
+	PeerBatchSize int
+
+	// PeerBatchLinger defines the duration, an incomplete batch of updates is held back in order
+	// to collect more updates. If zero, updates are sent immediately.
+	PeerBatchLinger time.Duration
+
+	// RelayHops defines the number of times an update is relayed from peer to peer. This is
+	// needed, if not all nodes are directly connected. If zero, updates are only sent to the
+	// direct peers of the node that performed the write.
+	RelayHops int
+
+	// ForwardMessages defines whether published messages are forwarded to the peers, so they
+	// reach the subscribers of all nodes.
+	ForwardMessages bool
+
+	// ReconcileInterval defines the interval in which the node reconciles with it's peers in order
+	// to repair missed updates. If zero, the node only reconciles at startup and on reconnects.
+	ReconcileInterval time.Duration
+
+	// ReconcilePeerCount defines the number of randomly chosen peers, the node reconciles with in
+	// each interval. If zero, all peers are reconciled.
+	ReconcilePeerCount int
+
+	// ReconcileBatchSize defines the number of values that are fetched with a single request during
+	// a reconciliation. If zero, DefaultReconcileBatchSize is used.
+	ReconcileBatchSize int
+
+	// ReconcileParallelism defines the number of concurrent requests during a reconciliation. If
+	// zero, DefaultReconcileParallelism is used.
+	ReconcileParallelism int
+
 	// TidyInterval defines the interval in which the store is cleaned up.
 	TidyInterval time.Duration
+
+	// TombstoneGracePeriod defines the minimal duration for which deleted values are kept before
+	// they are removed from the store.
+	TombstoneGracePeriod time.Duration
+
+	// ExpireInterval defines the interval in which expired values are turned into deleted values.
+	// If zero, expired values are only hidden from reads.
+	ExpireInterval time.Duration
+
+	// DataDir defines the directory where the store persists it's data. If empty, the data is
+	// only held in memory.
+	DataDir string
+
+	// DisableSync defines whether the write-ahead log is not synced to disk after each write. This
+	// speeds up writes, but acknowledged writes may be lost, if the machine crashes.
+	DisableSync bool
+
+	// SnapshotInterval defines the interval in which the write-ahead log of a persistent store is
+	// compacted into a snapshot. If zero, a snapshot is only written when the node is closed.
+	SnapshotInterval time.Duration
 }
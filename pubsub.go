@@ -0,0 +1,353 @@
+package deks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/simia-tech/errx"
+	redisserver "github.com/tidwall/redcon"
+)
+
+// recentMessagesSize defines the number of message ids, that are remembered in order to drop
+// messages, that are received more than once.
+const recentMessagesSize = 4096
+
+// messageID identifies a message by the node, it has been published on, and a sequence number.
+type messageID [nodeIDSize + 8]byte
+
+func parseMessageID(argument []byte) (messageID, error) {
+	id := messageID{}
+	if len(argument) != len(id) {
+		return id, errx.BadRequestf("invalid message id size %d", len(argument))
+	}
+	copy(id[:], argument)
+	return id, nil
+}
+
+// message defines a published message.
+type message struct {
+	id      messageID
+	channel []byte
+	payload []byte
+	hops    int
+}
+
+// Message defines a message, that has been received via a subscription.
+type Message struct {
+	// Pattern holds the pattern, that matched the channel. It's nil for subscriptions of a
+	// channel.
+	Pattern []byte
+	Channel []byte
+	Payload []byte
+}
+
+// subscriber defines the channel and pattern subscriptions of a session.
+type subscriber struct {
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	messages chan Message
+	dropped  bool
+}
+
+func newSubscriber() *subscriber {
+	return &subscriber{
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		messages: make(chan Message, watchBufferSize),
+	}
+}
+
+// subscriptions returns the subscriptions of the provided kind.
+func (sub *subscriber) subscriptions(pattern bool) map[string]struct{} {
+	if pattern {
+		return sub.patterns
+	}
+	return sub.channels
+}
+
+// broker fans published messages out to the subscribers.
+type broker struct {
+	origin      nodeID
+	sequence    uint64
+	channels    map[string]map[*subscriber]struct{}
+	patterns    map[string]map[*subscriber]struct{}
+	recent      []messageID
+	recentIndex int
+	recentSet   map[messageID]struct{}
+	mutex       sync.Mutex
+}
+
+func newBroker(origin nodeID) *broker {
+	return &broker{
+		origin:    origin,
+		channels:  make(map[string]map[*subscriber]struct{}),
+		patterns:  make(map[string]map[*subscriber]struct{}),
+		recent:    make([]messageID, recentMessagesSize),
+		recentSet: make(map[messageID]struct{}),
+	}
+}
+
+// newMessage returns a new message with a unique id.
+func (b *broker) newMessage(channel, payload []byte) message {
+	b.mutex.Lock()
+	b.sequence++
+	m := message{channel: channel, payload: payload}
+	copy(m.id[:], b.origin[:])
+	binary.BigEndian.PutUint64(m.id[nodeIDSize:], b.sequence)
+	b.mutex.Unlock()
+	return m
+}
+
+// subscribe adds a subscription of the provided channel or pattern.
+func (b *broker) subscribe(sub *subscriber, name []byte, pattern bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	sub.subscriptions(pattern)[string(name)] = struct{}{}
+	if sub.dropped {
+		return
+	}
+	index := b.index(pattern)
+	if index[string(name)] == nil {
+		index[string(name)] = make(map[*subscriber]struct{})
+	}
+	index[string(name)][sub] = struct{}{}
+}
+
+// unsubscribe removes the subscription of the provided channel or pattern.
+func (b *broker) unsubscribe(sub *subscriber, name []byte, pattern bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(sub.subscriptions(pattern), string(name))
+	b.removeFromIndex(sub, name, pattern)
+}
+
+// remove removes all subscriptions of the provided subscriber and closes it's channel.
+func (b *broker) remove(sub *subscriber) {
+	b.mutex.Lock()
+	b.drop(sub)
+	b.mutex.Unlock()
+}
+
+// deliver sends the provided message to all subscribers of it's channel and returns the number of
+// receivers. Messages, that have been delivered before, are ignored and false is returned.
+// Subscribers, that fall behind, are dropped.
+func (b *broker) deliver(m message) (int, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.recentSet[m.id]; ok {
+		return 0, false
+	}
+	delete(b.recentSet, b.recent[b.recentIndex])
+	b.recent[b.recentIndex] = m.id
+	b.recentSet[m.id] = struct{}{}
+	b.recentIndex = (b.recentIndex + 1) % len(b.recent)
+
+	count := 0
+	for sub := range b.channels[string(m.channel)] {
+		if b.send(sub, Message{Channel: m.channel, Payload: m.payload}) {
+			count++
+		}
+	}
+	for pattern, subs := range b.patterns {
+		if !matchPattern([]byte(pattern), m.channel) {
+			continue
+		}
+		for sub := range subs {
+			if b.send(sub, Message{Pattern: []byte(pattern), Channel: m.channel, Payload: m.payload}) {
+				count++
+			}
+		}
+	}
+	return count, true
+}
+
+func (b *broker) send(sub *subscriber, m Message) bool {
+	select {
+	case sub.messages <- m:
+		return true
+	default:
+		b.drop(sub)
+		return false
+	}
+}
+
+// drop removes the provided subscriber from the index and closes it's channel. The caller has to
+// hold the mutex.
+func (b *broker) drop(sub *subscriber) {
+	if sub.dropped {
+		return
+	}
+	sub.dropped = true
+	for name := range sub.channels {
+		b.removeFromIndex(sub, []byte(name), false)
+	}
+	for name := range sub.patterns {
+		b.removeFromIndex(sub, []byte(name), true)
+	}
+	close(sub.messages)
+}
+
+func (b *broker) removeFromIndex(sub *subscriber, name []byte, pattern bool) {
+	index := b.index(pattern)
+	subs := index[string(name)]
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(index, string(name))
+	}
+}
+
+func (b *broker) index(pattern bool) map[string]map[*subscriber]struct{} {
+	if pattern {
+		return b.patterns
+	}
+	return b.channels
+}
+
+// Publish sends the provided payload to all subscribers of the channel and returns the number of
+// local receivers. If message forwarding is enabled, the message is forwarded to all peers as
+// well.
+func (s *Server) Publish(channel, payload []byte) int {
+	m := s.broker.newMessage(channel, payload)
+	count, _ := s.broker.deliver(m)
+	s.forwardMessage(m)
+	return count
+}
+
+// SetMessageForwarding sets whether published messages are forwarded to the peers. Forwarded
+// messages are relayed as often as updates.
+func (s *Server) SetMessageForwarding(enabled bool) {
+	s.streamsMutex.Lock()
+	s.forwardMessages = enabled
+	s.streamsMutex.Unlock()
+}
+
+// forwardMessage passes the provided message on to all peers, if message forwarding is enabled.
+func (s *Server) forwardMessage(m message) {
+	s.streamsMutex.RLock()
+	defer s.streamsMutex.RUnlock()
+	if !s.forwardMessages {
+		return
+	}
+	for _, stream := range s.streams {
+		stream.publish(m)
+	}
+}
+
+// relayMessage delivers the provided message, that has been received from a peer, to the local
+// subscribers and passes it on to all peers, unless it has been seen before or it has reached
+// the hop limit.
+func (s *Server) relayMessage(m message) {
+	if _, ok := s.broker.deliver(m); !ok {
+		return
+	}
+	s.streamsMutex.RLock()
+	relayHops := s.relayHops
+	s.streamsMutex.RUnlock()
+	if m.hops >= relayHops {
+		return
+	}
+	m.hops++
+	s.forwardMessage(m)
+}
+
+// subscribe adds subscriptions of the provided channels or patterns to the session. The caller
+// has to hold the write mutex.
+func (s *Server) subscribe(conn net.Conn, w *redisserver.Writer, ss *session, command string, names [][]byte) {
+	if ss.subscriber == nil {
+		ss.subscriber = newSubscriber()
+		go s.streamMessages(conn, w, ss, ss.subscriber)
+	}
+	for _, name := range names {
+		s.broker.subscribe(ss.subscriber, name, command == cmdPSubscribe)
+		writeSubscriptionReply(w, command, name, ss.subscriptionCount())
+	}
+}
+
+// unsubscribe removes the subscriptions of the provided channels or patterns from the session. If
+// no names are provided, all subscriptions of the kind are removed. The caller has to hold the
+// write mutex.
+func (s *Server) unsubscribe(w *redisserver.Writer, ss *session, command string, names [][]byte) {
+	pattern := command == cmdPUnsubscribe
+	if len(names) == 0 && ss.subscriber != nil {
+		for name := range ss.subscriber.subscriptions(pattern) {
+			names = append(names, []byte(name))
+		}
+		sort.Slice(names, func(i, j int) bool { return bytes.Compare(names[i], names[j]) < 0 })
+	}
+	if len(names) == 0 {
+		writeSubscriptionReply(w, command, nil, ss.subscriptionCount())
+		return
+	}
+	for _, name := range names {
+		if ss.subscriber != nil {
+			s.broker.unsubscribe(ss.subscriber, name, pattern)
+		}
+		writeSubscriptionReply(w, command, name, ss.subscriptionCount())
+	}
+}
+
+// unsubscribeAll removes all subscriptions of the session. The caller has to hold the write
+// mutex.
+func (s *Server) unsubscribeAll(ss *session) {
+	if ss.subscriber == nil {
+		return
+	}
+	sub := ss.subscriber
+	ss.subscriber = nil
+	s.broker.remove(sub)
+}
+
+func (s *Server) streamMessages(conn net.Conn, w *redisserver.Writer, ss *session, sub *subscriber) {
+	for m := range sub.messages {
+		ss.writeMutex.Lock()
+		writeMessage(w, m)
+		err := w.Flush()
+		ss.writeMutex.Unlock()
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	ss.writeMutex.Lock()
+	defer ss.writeMutex.Unlock()
+	if ss.subscriber != sub {
+		return
+	}
+	w.WriteError("ERR subscriptions cancelled, because the client fell behind")
+	w.Flush()
+	conn.Close()
+}
+
+// subscriptionCount returns the number of observed prefixes, subscribed channels and subscribed
+// patterns of the session.
+func (ss *session) subscriptionCount() int {
+	count := len(ss.observed)
+	if ss.subscriber != nil {
+		count += len(ss.subscriber.channels) + len(ss.subscriber.patterns)
+	}
+	return count
+}
+
+func writeSubscriptionReply(w *redisserver.Writer, command string, name []byte, count int) {
+	w.WriteArray(3)
+	w.WriteBulkString(command)
+	writeBulkOrNull(w, name)
+	w.WriteInt(count)
+}
+
+func writeMessage(w *redisserver.Writer, m Message) {
+	if m.Pattern == nil {
+		w.WriteArray(3)
+		w.WriteBulkString("message")
+	} else {
+		w.WriteArray(4)
+		w.WriteBulkString("pmessage")
+		w.WriteBulk(m.Pattern)
+	}
+	w.WriteBulk(m.Channel)
+	w.WriteBulk(m.Payload)
+}
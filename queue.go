@@ -0,0 +1,212 @@
+package deks
+
+import (
+	"sync"
+	"time"
+
+	"github.com/simia-tech/errx"
+)
+
+// OverflowPolicy defines the behaviour of a peer's update queue, if it's full.
+type OverflowPolicy int
+
+const (
+	// OverflowDrop drops the update and marks the peer for a reconciliation.
+	OverflowDrop OverflowPolicy = iota
+
+	// OverflowBlock blocks the write until the queue has space again. If that takes longer than
+	// the queue timeout, the update is dropped and the peer is marked for a reconciliation.
+	OverflowBlock
+)
+
+const (
+	// DefaultPeerQueueSize defines the default number of updates, that are queued for a peer.
+	DefaultPeerQueueSize = 1024
+)
+
+// ParseOverflowPolicy returns the overflow policy with the provided name. Valid names are 'drop'
+// and 'block'.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "drop":
+		return OverflowDrop, nil
+	case "block":
+		return OverflowBlock, nil
+	}
+	return 0, errx.BadRequestf("invalid overflow policy [%s]", name)
+}
+
+func (op OverflowPolicy) String() string {
+	switch op {
+	case OverflowDrop:
+		return "drop"
+	case OverflowBlock:
+		return "block"
+	}
+	return "unknown"
+}
+
+// updateQueue holds the updates that haven't been sent to a peer yet. Updates of the same key are
+// coalesced, so only the latest version of each key is sent. Updates, that have been pushed
+// together, form an entry and are always popped together. The depth of the queue is the number
+// of entries.
+type updateQueue struct {
+	size    int
+	policy  OverflowPolicy
+	timeout time.Duration
+
+	order   []*queueEntry
+	pending map[keyHash]*queueEntry
+	mutex   sync.Mutex
+
+	ready chan struct{}
+	space chan struct{}
+}
+
+type queueEntry struct {
+	changes []change
+}
+
+func newUpdateQueue(size int, policy OverflowPolicy, timeout time.Duration) *updateQueue {
+	if size < 1 {
+		size = 1
+	}
+	return &updateQueue{
+		size:    size,
+		policy:  policy,
+		timeout: timeout,
+		pending: make(map[keyHash]*queueEntry),
+		ready:   make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+	}
+}
+
+// push adds the provided container to the queue and returns the resulting depth. If the
+// container couldn't be added, false is returned.
+func (q *updateQueue) push(kh keyHash, c *container) (int, bool) {
+	return q.pushChanges([]change{{keyHash: kh, container: c}})
+}
+
+// pushChanges adds the provided changes as a single entry to the queue and returns the resulting
+// depth. If some of the key hashes are already queued, the affected entries are merged with the
+// new one. If the changes couldn't be added, false is returned.
+func (q *updateQueue) pushChanges(changes []change) (int, bool) {
+	var deadline <-chan time.Time
+	for {
+		q.mutex.Lock()
+		entries := q.overlapping(changes)
+		if len(entries) > 0 || len(q.order) < q.size {
+			q.merge(entries, changes)
+			depth := len(q.order)
+			q.mutex.Unlock()
+			q.signal(q.ready)
+			return depth, true
+		}
+		depth := len(q.order)
+		q.mutex.Unlock()
+
+		if q.policy != OverflowBlock || q.timeout <= 0 {
+			return depth, false
+		}
+		if deadline == nil {
+			timer := time.NewTimer(q.timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-q.space:
+		case <-deadline:
+			return depth, false
+		}
+	}
+}
+
+// pop removes the oldest entry from the queue and returns it's changes and the resulting depth.
+// If the queue is empty, false is returned.
+func (q *updateQueue) pop() ([]change, int, bool) {
+	q.mutex.Lock()
+	if len(q.order) == 0 {
+		q.mutex.Unlock()
+		return nil, 0, false
+	}
+	e := q.order[0]
+	q.order = q.order[1:]
+	for _, ch := range e.changes {
+		delete(q.pending, ch.keyHash)
+	}
+	depth := len(q.order)
+	q.mutex.Unlock()
+	q.signal(q.space)
+	return e.changes, depth, true
+}
+
+// overlapping returns the queued entries, that contain one of the key hashes of the provided
+// changes.
+func (q *updateQueue) overlapping(changes []change) []*queueEntry {
+	entries := []*queueEntry{}
+	for _, ch := range changes {
+		e, ok := q.pending[ch.keyHash]
+		if !ok {
+			continue
+		}
+		found := false
+		for _, other := range entries {
+			found = found || other == e
+		}
+		if !found {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// merge adds the provided changes to the first of the provided entries and merges the other
+// entries into it. If no entries are provided, a new one is appended to the queue.
+func (q *updateQueue) merge(entries []*queueEntry, changes []change) {
+	var e *queueEntry
+	if len(entries) == 0 {
+		e = &queueEntry{}
+		q.order = append(q.order, e)
+	} else {
+		e = entries[0]
+		for _, other := range entries[1:] {
+			changes = append(other.changes, changes...)
+			q.remove(other)
+		}
+	}
+	for _, ch := range changes {
+		e.changes = coalesce(e.changes, ch)
+		q.pending[ch.keyHash] = e
+	}
+}
+
+func (q *updateQueue) remove(e *queueEntry) {
+	for index, other := range q.order {
+		if other == e {
+			q.order = append(q.order[:index], q.order[index+1:]...)
+			return
+		}
+	}
+}
+
+func (q *updateQueue) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce replaces the change of the same key with the provided one, unless the queued one is
+// newer. The changes are pushed after the store lock has been released, so they may arrive out
+// of order.
+func coalesce(changes []change, ch change) []change {
+	for index, pc := range changes {
+		if string(pc.container.key) == string(ch.container.key) {
+			if !pc.container.newerThan(ch.container) {
+				changes[index] = ch
+			}
+			return changes
+		}
+	}
+	return append(changes, ch)
+}
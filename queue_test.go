@@ -0,0 +1,72 @@
+package deks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateQueueCoalescesUpdates(t *testing.T) {
+	q := newUpdateQueue(2, OverflowDrop, 0)
+	kh := keyHash{1}
+
+	depth, ok := q.push(kh, &container{key: []byte("key"), revision: 0})
+	require.True(t, ok)
+	assert.Equal(t, 1, depth)
+	depth, ok = q.push(kh, &container{key: []byte("key"), revision: 1})
+	require.True(t, ok)
+	assert.Equal(t, 1, depth)
+	depth, ok = q.push(kh, &container{key: []byte("colliding key"), revision: 0})
+	require.True(t, ok)
+	assert.Equal(t, 1, depth)
+
+	changes, depth, ok := q.pop()
+	require.True(t, ok)
+	assert.Equal(t, 0, depth)
+	require.Len(t, changes, 2)
+	assert.Equal(t, kh, changes[0].keyHash)
+	assert.Equal(t, uint64(1), changes[0].container.revision)
+	assert.Equal(t, []byte("colliding key"), changes[1].container.key)
+
+	_, _, ok = q.pop()
+	assert.False(t, ok)
+}
+
+func TestUpdateQueueDropsOnOverflow(t *testing.T) {
+	q := newUpdateQueue(1, OverflowDrop, 0)
+
+	_, ok := q.push(keyHash{1}, &container{key: []byte("one")})
+	require.True(t, ok)
+	depth, ok := q.push(keyHash{2}, &container{key: []byte("two")})
+	assert.False(t, ok)
+	assert.Equal(t, 1, depth)
+}
+
+func TestUpdateQueueBlocksOnOverflow(t *testing.T) {
+	q := newUpdateQueue(1, OverflowBlock, time.Second)
+
+	_, ok := q.push(keyHash{1}, &container{key: []byte("one")})
+	require.True(t, ok)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.pop()
+	}()
+
+	_, ok = q.push(keyHash{2}, &container{key: []byte("two")})
+	assert.True(t, ok)
+}
+
+func TestUpdateQueueBlocksOnOverflowUntilTimeout(t *testing.T) {
+	q := newUpdateQueue(1, OverflowBlock, 20*time.Millisecond)
+
+	_, ok := q.push(keyHash{1}, &container{key: []byte("one")})
+	require.True(t, ok)
+
+	start := time.Now()
+	_, ok = q.push(keyHash{2}, &container{key: []byte("two")})
+	assert.False(t, ok)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+}
@@ -0,0 +1,70 @@
+package deks
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/simia-tech/conflux"
+	"github.com/simia-tech/conflux/recon"
+	"github.com/simia-tech/errx"
+)
+
+// reconTap records all data that is written to the underlying connection during a
+// reconciliation. Since the reconciliation only returns the items, the local node is missing,
+// the recorded messages are used to determine the items the remote node is missing. This relies
+// on conflux's message layout, so conflux is pinned in go.mod and the layout is checked against
+// a recorded reconciliation in the tests.
+type reconTap struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (rt *reconTap) Write(data []byte) (int, error) {
+	rt.written.Write(data)
+	return rt.Conn.Write(data)
+}
+
+// remoteNeeds returns the items that have been sent to the remote node as elements it doesn't
+// hold. The recorded stream starts with the config handshake, that is skipped. Any message, that
+// the initiator of a reconciliation isn't expected to send, results in an error, so a change of
+// conflux's message layout doesn't go unnoticed.
+func (rt *reconTap) remoteNeeds() ([][]byte, error) {
+	r := bytes.NewReader(rt.written.Bytes())
+	if _, err := recon.ReadMsg(r); err != nil {
+		return nil, errx.Annotatef(err, "read config")
+	}
+	if _, err := recon.ReadString(r); err != nil {
+		return nil, errx.Annotatef(err, "read config status")
+	}
+
+	result := [][]byte{}
+	for r.Len() > 0 {
+		message, err := recon.ReadMsg(r)
+		if err != nil {
+			return nil, errx.Annotatef(err, "read message")
+		}
+		var zset *conflux.ZSet
+		switch m := message.(type) {
+		case *recon.Elements:
+			zset = m.ZSet
+		case *recon.FullElements:
+			zset = m.ZSet
+		case *recon.SyncFail:
+			continue
+		default:
+			return nil, errx.Errorf("unexpected message %T in recorded reconciliation", m)
+		}
+		for _, element := range zset.Items() {
+			result = append(result, zpBytes(element))
+		}
+	}
+	return result, nil
+}
+
+func zpBytes(zp *conflux.Zp) []byte {
+	zb := zp.Bytes()
+	for len(zb) < recon.SksZpNbytes {
+		zb = append(zb, byte(0))
+	}
+	return zb[:len(zb)-1]
+}
@@ -0,0 +1,58 @@
+package deks
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/simia-tech/conflux"
+	"github.com/simia-tech/conflux/recon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordedReconciliation holds the messages, the initiator of a reconciliation writes, in the
+// encoding of the pinned conflux version: the config, the config status, an elements message,
+// a sync failure and a full elements message.
+const recordedReconciliation = "000000630a000000050000000776657273696f6e00000005312e312e3300000009" +
+	"6874747020706f727400000004000000000000000a6269747175616e74756d0000000400000002000000046d626172" +
+	"00000004000000050000000766696c746572730000000000000006706173736564000000160200000001010203040506" +
+	"070800000000000000010000000001040000001603000000010807060504030201000000000000000200"
+
+var (
+	recordedElementItem     = stateItem(keyHash{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, 1)
+	recordedFullElementItem = stateItem(keyHash{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}, 2)
+)
+
+func TestReconTapMessageEncoding(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	require.NoError(t, recon.WriteMsg(buffer, &recon.Config{Version: "1.1.3", BitQuantum: 2, MBar: 5}))
+	require.NoError(t, recon.WriteString(buffer, recon.RemoteConfigPassed))
+	require.NoError(t, recon.WriteMsg(buffer,
+		&recon.Elements{ZSet: conflux.NewZSet(conflux.Zb(p, recordedElementItem[:]))},
+		&recon.SyncFail{},
+		&recon.FullElements{ZSet: conflux.NewZSet(conflux.Zb(p, recordedFullElementItem[:]))}))
+
+	assert.Equal(t, recordedReconciliation, hex.EncodeToString(buffer.Bytes()))
+}
+
+func TestReconTapRemoteNeeds(t *testing.T) {
+	data, err := hex.DecodeString(recordedReconciliation)
+	require.NoError(t, err)
+	rt := &reconTap{}
+	rt.written.Write(data)
+
+	items, err := rt.remoteNeeds()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{recordedElementItem[:], recordedFullElementItem[:]}, items)
+}
+
+func TestReconTapRemoteNeedsRejectsUnexpectedMessage(t *testing.T) {
+	rt := &reconTap{}
+	require.NoError(t, recon.WriteMsg(&rt.written, &recon.Config{Version: "1.1.3", BitQuantum: 2, MBar: 5}))
+	require.NoError(t, recon.WriteString(&rt.written, recon.RemoteConfigPassed))
+	require.NoError(t, recon.WriteMsg(&rt.written, &recon.Done{}))
+
+	_, err := rt.remoteNeeds()
+	assert.Error(t, err)
+}
@@ -0,0 +1,65 @@
+package deks
+
+import "bytes"
+
+// Resolver defines the interface to merge conflicting values. It's called if a remote value
+// arrives for a key that holds a different local value. Both values are present, deleted
+// values are resolved by revision.
+//
+// The merge must be idempotent, which means that merging a value with an already merged
+// value has to return the merged value again. Otherwise, the nodes would never stop to
+// exchange new merge results.
+//
+// The resolver is called while the store is locked for writing, so it blocks all reads and writes
+// of the store until it returns. It must be fast and must not access the store, otherwise the
+// node stalls or deadlocks.
+type Resolver interface {
+	Resolve(local, remote Entry) ([]byte, error)
+}
+
+// ResolverFunc defines a function that implements the Resolver interface.
+type ResolverFunc func(local, remote Entry) ([]byte, error)
+
+// Resolve calls the function.
+func (rf ResolverFunc) Resolve(local, remote Entry) ([]byte, error) {
+	return rf(local, remote)
+}
+
+type prefixResolver struct {
+	prefix   []byte
+	resolver Resolver
+}
+
+// SetResolver registers the provided resolver for all keys with the provided prefix. An empty
+// prefix registers the resolver for all keys. If multiple prefixes match a key, the longest
+// one is used. A nil resolver removes the registration.
+func (s *Store) SetResolver(prefix []byte, r Resolver) {
+	s.containersRWMutex.Lock()
+	defer s.containersRWMutex.Unlock()
+	for index, pr := range s.resolvers {
+		if bytes.Equal(pr.prefix, prefix) {
+			if r == nil {
+				s.resolvers = append(s.resolvers[:index], s.resolvers[index+1:]...)
+			} else {
+				s.resolvers[index].resolver = r
+			}
+			return
+		}
+	}
+	if r != nil {
+		s.resolvers = append(s.resolvers, prefixResolver{prefix: prefix, resolver: r})
+	}
+}
+
+func (s *Store) resolverFor(key []byte) Resolver {
+	var result *prefixResolver
+	for index, pr := range s.resolvers {
+		if bytes.HasPrefix(key, pr.prefix) && (result == nil || len(pr.prefix) > len(result.prefix)) {
+			result = &s.resolvers[index]
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	return result.resolver
+}
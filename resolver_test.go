@@ -0,0 +1,91 @@
+package deks_test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simia-tech/deks"
+)
+
+func TestResolverOnReconcilate(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.storeTwo.SetResolver(nil, deks.ResolverFunc(unionResolve))
+
+	require.NoError(t, e.storeOne.Set(testKey, []byte("a")))
+	require.NoError(t, e.storeOne.Set(testKey, []byte("a,c")))
+	require.NoError(t, e.storeTwo.Set(testKey, []byte("b")))
+
+	_, err := e.serverTwo.Reconcilate(e.serverOne.ListenURL())
+	require.NoError(t, err)
+
+	value, err := e.storeTwo.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a,b,c"), value)
+	assert.Equal(t, []deks.Item{{0xa6, 0x2f, 0x22, 0x25, 0xbf, 0x70, 0xbf, 0xac, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2}}, e.storeTwo.State().Items())
+}
+
+func TestResolverWithPrefix(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.storeTwo.SetResolver([]byte("other"), deks.ResolverFunc(unionResolve))
+
+	require.NoError(t, e.storeOne.Set(testKey, []byte("a")))
+	require.NoError(t, e.storeOne.Set(testKey, []byte("a,c")))
+	require.NoError(t, e.storeTwo.Set(testKey, []byte("b")))
+
+	_, err := e.serverTwo.Reconcilate(e.serverOne.ListenURL())
+	require.NoError(t, err)
+
+	value, err := e.storeTwo.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a,c"), value)
+}
+
+func TestResolverPropagatesMergedValue(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.storeOne.SetResolver(nil, deks.ResolverFunc(unionResolve))
+	e.storeTwo.SetResolver(nil, deks.ResolverFunc(unionResolve))
+
+	require.NoError(t, e.storeOne.Set(testKey, []byte("a")))
+	require.NoError(t, e.storeTwo.Set(testKey, []byte("b")))
+
+	e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, time.Minute)
+	e.serverTwo.AddPeer(e.serverOne.ListenURL(), time.Minute, time.Minute)
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, []byte("a,c")))
+	time.Sleep(100 * time.Millisecond)
+
+	valueOne, err := e.storeOne.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a,b,c"), valueOne)
+
+	valueTwo, err := e.storeTwo.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a,b,c"), valueTwo)
+}
+
+func unionResolve(local, remote deks.Entry) ([]byte, error) {
+	ids := map[string]struct{}{}
+	for _, value := range [][]byte{local.Value, remote.Value} {
+		for _, id := range strings.Split(string(value), ",") {
+			ids[id] = struct{}{}
+		}
+	}
+	result := []string{}
+	for id := range ids {
+		result = append(result, id)
+	}
+	sort.Strings(result)
+	return []byte(strings.Join(result, ",")), nil
+}
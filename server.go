@@ -1,11 +1,15 @@
 package deks
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,28 +23,115 @@ const (
 	cmdHelp         = "help"
 	cmdQuit         = "quit"
 	cmdPing         = "ping"
+	cmdAuth         = "auth"
 	cmdSet          = "set"
 	cmdGet          = "get"
+	cmdGetRev       = "getrev"
+	cmdCompareSet   = "cas"
+	cmdCompareDel   = "cad"
 	cmdDelete       = "del"
 	cmdKeys         = "keys"
+	cmdExpire       = "expire"
+	cmdPExpire      = "pexpire"
+	cmdTTL          = "ttl"
+	cmdPersist      = "persist"
+	cmdMeta         = "meta"
 	cmdPeerAdd      = "padd"
 	cmdPeerRemove   = "pdel"
 	cmdPeerList     = "plist"
 	cmdTidy         = "tidy"
+	cmdMembers      = "members"
+	cmdExists       = "exists"
+	cmdMGet         = "mget"
+	cmdMSet         = "mset"
+	cmdDBSize       = "dbsize"
+	cmdScan         = "scan"
+	cmdRange        = "range"
+	cmdPrefix       = "prefix"
+	cmdInfo         = "info"
+	cmdEcho         = "echo"
+	cmdSelect       = "select"
+	cmdCommand      = "command"
+	cmdMulti        = "multi"
+	cmdExec         = "exec"
+	cmdDiscard      = "discard"
+	cmdWatch        = "watch"
+	cmdUnwatch      = "unwatch"
+	cmdObserve      = "observe"
+	cmdUnobserve    = "unobserve"
+	cmdPublish      = "publish"
+	cmdSubscribe    = "subscribe"
+	cmdUnsubscribe  = "unsubscribe"
+	cmdPSubscribe   = "psubscribe"
+	cmdPUnsubscribe = "punsubscribe"
 	cmdSetContainer = "cset"        // hidden
 	cmdGetContainer = "cget"        // hidden
+	cmdGetBatch     = "cmget"       // hidden
+	cmdSetBatch     = "cmset"       // hidden
+	cmdGetRevisions = "crev"        // hidden
 	cmdReconcilate  = "reconcilate" // hidden
+	cmdMemberPing   = "mping"       // hidden
+	cmdMemberPingRq = "mpingreq"    // hidden
+	cmdPeerPublish  = "cpub"        // hidden
+	cmdHello        = "hello"       // hidden
+
+	// DefaultPeerBatchSize defines the default number of bytes, that are collected before a batch
+	// of updates is sent to a peer.
+	DefaultPeerBatchSize = 64 * 1024
+	// DefaultPeerBatchLinger defines the default duration, a batch of updates is held back in
+	// order to collect more updates.
+	DefaultPeerBatchLinger = 2 * time.Millisecond
+
+	// DefaultReconcileBatchSize defines the default number of buckets that are fetched with a
+	// single request during a reconciliation.
+	DefaultReconcileBatchSize = 1000
+	// DefaultReconcileParallelism defines the default number of concurrent requests during a
+	// reconciliation.
+	DefaultReconcileParallelism = 4
 
 	help = `Supported commands:
 help                                            - prints this help message
-set <key> <value>                               - sets <value> at <key>
+auth [<user>] <password>                        - authenticates the connection
+set <key> <value> [EX <s>|PX <ms>] [NX|XX]      - sets <value> at <key> with an optional expiry, only if absent (NX) or present (XX)
 get <key>                                       - returns value at <key>
-del <key>                                       - removes value at <key>
-keys                                            - returns all keys
+getrev <key>                                    - returns value and revision at <key>
+cas <key> <revision> <value>                    - sets <value> at <key>, if the value's revision is <revision>
+cad <key> <revision>                            - removes the value at <key>, if it's revision is <revision>
+del <key> [<key> ...]                           - removes the values at the keys and returns their number
+exists <key> [<key> ...]                        - returns the number of existing keys
+mget <key> [<key> ...]                          - returns the values at the keys
+mset <key> <value> [<key> <value> ...]          - sets the values at the keys
+keys [<pattern>]                                - returns all keys matching the optional <pattern>
+scan <cursor> [MATCH <pattern>] [COUNT <count>] - returns the next cursor and a page of keys
+range <start> <end> <cursor> [COUNT <n>] [REV]  - returns the next cursor and a page of the ordered keys in [<start>, <end>)
+prefix <prefix> <cursor> [COUNT <n>] [REV]      - returns the next cursor and a page of the ordered keys with <prefix>
+dbsize                                          - returns the number of keys
+expire <key> <seconds>                          - sets an expiry on the value at <key>
+pexpire <key> <milliseconds>                    - sets an expiry in milliseconds on the value at <key>
+ttl <key>                                       - returns the remaining seconds to live of <key>
+persist <key>                                   - removes the expiry of the value at <key>
+meta <key>                                      - returns revision, timestamp and origin of <key>
 padd <url> <ping interval> <reconnect interval> - adds a peer with <url>
 pdel <url>                                      - removes the peer with <url>
 plist                                           - returns all peer urls
+members                                         - returns url, state and incarnation of all cluster members
 tidy                                            - cleans up the store
+info [<section>]                                - returns information about the node
+echo <message>                                  - returns <message>
+select <index>                                  - selects the database, only 0 is supported
+command [COUNT|INFO <name> ...]                 - returns details about the supported commands
+multi                                           - starts a transaction, the following commands are queued
+exec                                            - runs all queued commands atomically
+discard                                         - discards all queued commands
+watch <key> [<key> ...]                         - aborts the next transaction, if one of the keys changes
+unwatch                                         - forgets all watched keys
+observe <prefix> [<prefix> ...]                 - streams the changes of all keys with one of the prefixes
+unobserve [<prefix> ...]                        - stops streaming the changes of the prefixes or of all prefixes
+publish <channel> <message>                     - sends <message> to the subscribers of <channel>
+subscribe <channel> [<channel> ...]             - streams the messages sent to the channels
+unsubscribe [<channel> ...]                     - stops streaming the messages of the channels or of all channels
+psubscribe <pattern> [<pattern> ...]            - streams the messages sent to channels matching the patterns
+punsubscribe [<pattern> ...]                    - stops streaming the messages of the patterns or of all patterns
 quit                                            - closes the connection
 `
 )
@@ -49,35 +140,92 @@ quit                                            - closes the connection
 type Server struct {
 	store        *Store
 	listener     net.Listener
+	secure       bool
+	tlsConfig    *tls.Config
 	metric       Metric
-	peer         *recon.Peer
 	streams      map[string]*stream
 	streamsMutex sync.RWMutex
+	conns        map[net.Conn]struct{}
+	connsMutex   sync.Mutex
+
+	reconcileBatchSize   int
+	reconcileParallelism int
+	reconcileMutex       sync.RWMutex
+
+	peerQueueSize    int
+	peerQueuePolicy  OverflowPolicy
+	peerQueueTimeout time.Duration
+	peerBatchSize    int
+	peerBatchLinger  time.Duration
+	relayHops        int
+	forwardMessages  bool
+
+	broker *broker
+
+	membership                  *membership
+	memberPeers                 map[string]struct{}
+	memberEnabled               bool
+	memberPeerPingInterval      time.Duration
+	memberPeerReconnectInterval time.Duration
+	memberMutex                 sync.Mutex
+
+	clusterName string
+	peerIDs     map[string]nodeID
+
+	users        map[string]*User
+	peerUser     string
+	peerPassword string
+	usersMutex   sync.RWMutex
 }
 
 // NewServer returns a new server.
 func NewServer(store *Store, listenURL string, m Metric) (*Server, error) {
-	network, address, err := parseURL(listenURL)
+	return NewServerWithTLS(store, listenURL, nil, m)
+}
+
+// NewServerWithTLS returns a new server. The provided tls config is used for a listen url in
+// format 'tls://localhost:5000' and for all connections to peers with such urls.
+func NewServerWithTLS(store *Store, listenURL string, tlsConfig *tls.Config, m Metric) (*Server, error) {
+	network, address, secure, err := parseURL(listenURL)
 	if err != nil {
 		return nil, errx.Annotatef(err, "parse listen url [%s]", listenURL)
 	}
 
-	l, err := net.Listen(network, address)
+	l, err := listen(network, address, secure, tlsConfig)
 	if err != nil {
 		return nil, errx.Annotatef(err, "listen [%s %s]", network, address)
 	}
 
-	settings := recon.DefaultSettings()
-	peer := recon.NewPeer(settings, store.State().prefixTree())
-
 	s := &Server{
-		store:    store,
-		listener: l,
-		metric:   m,
-		peer:     peer,
-		streams:  make(map[string]*stream, 0),
+		store:     store,
+		listener:  l,
+		secure:    secure,
+		tlsConfig: tlsConfig,
+		metric:    m,
+		streams:   make(map[string]*stream, 0),
+		conns:     make(map[net.Conn]struct{}),
+
+		reconcileBatchSize:   DefaultReconcileBatchSize,
+		reconcileParallelism: DefaultReconcileParallelism,
+
+		peerQueueSize:   DefaultPeerQueueSize,
+		peerQueuePolicy: OverflowDrop,
+		peerBatchSize:   DefaultPeerBatchSize,
+		peerBatchLinger: DefaultPeerBatchLinger,
+
+		memberPeers:                 make(map[string]struct{}),
+		memberPeerPingInterval:      time.Second,
+		memberPeerReconnectInterval: 5 * time.Second,
+
+		clusterName: DefaultClusterName,
+		peerIDs:     make(map[string]nodeID),
+
+		broker: newBroker(store.nodeID),
 	}
+	s.membership = newMembership(s.ListenURL())
 	store.updateFn = s.update
+	store.acknowledgedFn = s.acknowledged
+	store.purgedFn = s.purged
 	go s.acceptLoop()
 	return s, nil
 }
@@ -85,23 +233,60 @@ func NewServer(store *Store, listenURL string, m Metric) (*Server, error) {
 // ListenURL returns the url of the listener.
 func (s *Server) ListenURL() string {
 	addr := s.listener.Addr()
+	if s.secure {
+		return fmt.Sprintf("%s://%s", schemeTLS, addr.String())
+	}
 	return fmt.Sprintf("%s://%s", addr.Network(), addr.String())
 }
 
 // Close tears down the node.
 func (s *Server) Close() error {
+	s.streamsMutex.RLock()
 	for _, stream := range s.streams {
 		stream.close()
 	}
-	if err := s.listener.Close(); err != nil {
-		if isClosedNetworkError(err) {
-			return nil
-		}
+	s.streamsMutex.RUnlock()
+	if err := s.listener.Close(); err != nil && !isClosedNetworkError(err) {
 		return errx.Annotatef(err, "close listener")
 	}
+	s.connsMutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsMutex.Unlock()
 	return nil
 }
 
+// SetPeerQueue sets the number of updates, that are queued for each peer, and the policy that
+// is applied if a queue is full. The timeout is only used by OverflowBlock. The settings apply
+// to peers that are added afterwards.
+func (s *Server) SetPeerQueue(size int, policy OverflowPolicy, timeout time.Duration) {
+	s.streamsMutex.Lock()
+	s.peerQueueSize = size
+	s.peerQueuePolicy = policy
+	s.peerQueueTimeout = timeout
+	s.streamsMutex.Unlock()
+}
+
+// SetPeerBatching sets the number of bytes, that are collected before a batch of updates is sent
+// to a peer, and the duration, an incomplete batch is held back in order to collect more
+// updates. The settings apply to peers that are added afterwards.
+func (s *Server) SetPeerBatching(size int, linger time.Duration) {
+	s.streamsMutex.Lock()
+	s.peerBatchSize = size
+	s.peerBatchLinger = linger
+	s.streamsMutex.Unlock()
+}
+
+// SetRelayHops sets the number of times an update is relayed to other peers. If zero, updates
+// that have been received from a peer are not relayed. Updates that have been seen before are
+// never relayed, so loops in the peer topology don't lead to endless relays.
+func (s *Server) SetRelayHops(hops int) {
+	s.streamsMutex.Lock()
+	s.relayHops = hops
+	s.streamsMutex.Unlock()
+}
+
 // AddPeer adds another node as a target for updates.
 func (s *Server) AddPeer(
 	peerURL string,
@@ -113,7 +298,8 @@ func (s *Server) AddPeer(
 		s.streamsMutex.Unlock()
 		return errx.AlreadyExistsf("peer with url [%s] already exists", peerURL)
 	}
-	s.streams[peerURL] = newStream(peerURL, peerPingInterval, peerReconnectInterval, s.metric)
+	queue := newUpdateQueue(s.peerQueueSize, s.peerQueuePolicy, s.peerQueueTimeout)
+	s.streams[peerURL] = newStream(peerURL, peerPingInterval, peerReconnectInterval, queue, s.peerBatchSize, s.peerBatchLinger, s.store, s.dialStream, s.ReconcilateBidirectional, s.metric)
 	s.streamsMutex.Unlock()
 	return nil
 }
@@ -128,6 +314,7 @@ func (s *Server) RemovePeer(peerURL string) error {
 	}
 	stream.close()
 	delete(s.streams, peerURL)
+	delete(s.peerIDs, peerURL)
 	s.streamsMutex.Unlock()
 	return nil
 }
@@ -143,42 +330,216 @@ func (s *Server) PeerURLs() []string {
 	return result
 }
 
-// Reconcilate performs a reconsiliation with the node at the provided address.
+// SetReconcileBatching sets the number of buckets that are fetched with a single request and the
+// number of requests that are performed concurrently during a reconciliation. Values lower
+// than one are set to one.
+func (s *Server) SetReconcileBatching(batchSize, parallelism int) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	s.reconcileMutex.Lock()
+	s.reconcileBatchSize = batchSize
+	s.reconcileParallelism = parallelism
+	s.reconcileMutex.Unlock()
+}
+
+// Reconcilate performs a reconsiliation with the node at the provided address. All values, the
+// remote node holds in a different version, are fetched and applied, if they're newer. The
+// number of fetched keys is returned.
 func (s *Server) Reconcilate(url string) (int, error) {
-	conn, err := Dial(url)
+	pulled, _, err := s.reconcilate(url, false)
+	return pulled, err
+}
+
+// ReconcilateBidirectional performs a reconsiliation with the node at the provided address.
+// In addition to Reconcilate, all values the remote node is missing or holds in a different
+// version, are sent to it. On both sides, only newer values are applied, so after a single call,
+// both nodes have converged. The numbers of fetched and sent keys are returned.
+func (s *Server) ReconcilateBidirectional(url string) (int, int, error) {
+	return s.reconcilate(url, true)
+}
+
+func (s *Server) reconcilate(url string, push bool) (int, int, error) {
+	conn, _, err := s.dialPeer(url, 0)
 	if err != nil {
-		return 0, errx.Annotatef(err, "dial [%s]", url)
+		return 0, 0, errx.Annotatef(err, "dial [%s]", url)
 	}
 	defer conn.Close()
 
 	netConn, err := conn.Reconsilate()
 	if err != nil {
-		return 0, errx.Annotatef(err, "reconcilate")
+		return 0, 0, errx.Annotatef(err, "reconcilate")
 	}
 
-	keyHashes, _, err := s.peer.Reconcilate(netConn, 100)
+	tap := &reconTap{Conn: netConn}
+	keyHashes, _, err := s.newReconPeer().Reconcilate(tap, 100)
 	if err != nil {
-		return 0, errx.Annotatef(err, "reconcilate")
+		return 0, 0, errx.Annotatef(err, "reconcilate")
 	}
 
-	payloadConn, err := Dial(url)
+	applied, err := s.fetchContainers(url, keyHashes)
+	if err != nil {
+		return 0, 0, errx.Annotatef(err, "fetch containers")
+	}
+
+	pushed, accepted := 0, 0
+	if push {
+		remoteNeeds, err := tap.remoteNeeds()
+		if err != nil {
+			return 0, 0, errx.Annotatef(err, "remote needs")
+		}
+		payloadConn, _, err := s.dialPeer(url, 0)
+		if err != nil {
+			return 0, 0, errx.Annotatef(err, "dial [%s]", url)
+		}
+		defer payloadConn.Close()
+		pushed, accepted, err = s.pushContainers(payloadConn, remoteNeeds)
+		if err != nil {
+			return 0, 0, errx.Annotatef(err, "push containers")
+		}
+	}
+
+	s.metric.Reconcilated(url, applied+accepted)
+
+	return len(keyHashes), pushed, nil
+}
+
+// fetchContainers fetches the buckets of the provided items from the remote node and applies
+// them to the store. The items are split into batches, that are requested over multiple
+// connections concurrently. The number of containers, that have been applied, is returned.
+func (s *Server) fetchContainers(url string, items [][]byte) (int, error) {
+	if len(items) == 0 {
+		return 0, nil
+	}
+
+	s.reconcileMutex.RLock()
+	batchSize, parallelism := s.reconcileBatchSize, s.reconcileParallelism
+	s.reconcileMutex.RUnlock()
+
+	batches := make(chan []keyHash, (len(items)+batchSize-1)/batchSize)
+	for start := 0; start < len(items); start += batchSize {
+		end := start + batchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		batch := make([]keyHash, end-start)
+		for index, item := range items[start:end] {
+			batch[index] = newKeyHash(item)
+		}
+		batches <- batch
+	}
+	close(batches)
+
+	if parallelism > len(batches) {
+		parallelism = len(batches)
+	}
+	type fetchResult struct {
+		applied int
+		err     error
+	}
+	results := make(chan fetchResult, parallelism)
+	for index := 0; index < parallelism; index++ {
+		go func() {
+			applied, err := s.fetchBatches(url, batches)
+			results <- fetchResult{applied: applied, err: err}
+		}()
+	}
+	applied := 0
+	var err error
+	for index := 0; index < parallelism; index++ {
+		result := <-results
+		applied += result.applied
+		if result.err != nil && err == nil {
+			err = result.err
+		}
+	}
+	return applied, err
+}
+
+func (s *Server) fetchBatches(url string, batches <-chan []keyHash) (int, error) {
+	conn, _, err := s.dialPeer(url, 0)
 	if err != nil {
 		return 0, errx.Annotatef(err, "dial [%s]", url)
 	}
-	defer payloadConn.Close()
+	defer conn.Close()
+
+	applied := 0
+	for batch := range batches {
+		buckets, err := conn.getContainerBatch(batch)
+		if err != nil {
+			return applied, errx.Annotatef(err, "get container batch")
+		}
+		updates := []containerUpdate{}
+		for index, containers := range buckets {
+			for _, c := range containers {
+				updates = append(updates, containerUpdate{keyHash: batch[index], bytes: c})
+			}
+		}
+		containers, err := s.store.setContainers(updates)
+		if err != nil {
+			return applied, errx.Annotatef(err, "set containers")
+		}
+		applied += len(containers)
+	}
+	return applied, nil
+}
 
-	for _, keyHash := range keyHashes {
-		kh := newKeyHash(keyHash)
-		c, err := payloadConn.getContainer(kh)
+// pushContainers sends the buckets of the provided items to the remote node and returns the
+// number of sent buckets and the number of containers, the remote node has accepted.
+func (s *Server) pushContainers(conn *Conn, items [][]byte) (int, int, error) {
+	pushed := map[keyHash]struct{}{}
+	accepted := 0
+	for _, item := range items {
+		kh := newKeyHash(item)
+		if _, ok := pushed[kh]; ok {
+			continue
+		}
+		containers, err := s.store.getContainers(kh, containerVersion(conn.version))
 		if err != nil {
-			return 0, errx.Annotatef(err, "get container")
+			return 0, 0, errx.Annotatef(err, "get containers [%s]", kh)
 		}
-		if err := s.store.setContainer(kh, c); err != nil {
-			return 0, errx.Annotatef(err, "set container")
+		if len(containers) == 0 {
+			continue
+		}
+		count, err := conn.setContainer(kh, containers...)
+		if err != nil {
+			return 0, 0, errx.Annotatef(err, "set container [%s]", kh)
 		}
+		pushed[kh] = struct{}{}
+		accepted += count
+	}
+	return len(pushed), accepted, nil
+}
+
+// ReconcilatePeers performs a bidirectional reconciliation with the provided number of randomly chosen
+// peers. If the count is zero or exceeds the number of peers, all peers are reconciled. The
+// total number of repaired keys is returned.
+func (s *Server) ReconcilatePeers(count int) (int, error) {
+	peerURLs := s.PeerURLs()
+	rand.Shuffle(len(peerURLs), func(i, j int) {
+		peerURLs[i], peerURLs[j] = peerURLs[j], peerURLs[i]
+	})
+	if count > 0 && count < len(peerURLs) {
+		peerURLs = peerURLs[:count]
 	}
 
-	return len(keyHashes), nil
+	total := 0
+	errs := []string{}
+	for _, peerURL := range peerURLs {
+		pulled, pushed, err := s.ReconcilateBidirectional(peerURL)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", peerURL, err))
+			continue
+		}
+		total += pulled + pushed
+	}
+	if len(errs) > 0 {
+		return total, errx.Errorf("reconcilate failed for %d of %d peers: %s", len(errs), len(peerURLs), strings.Join(errs, "; "))
+	}
+	return total, nil
 }
 
 func (s *Server) acceptLoop() {
@@ -204,8 +565,17 @@ func (s *Server) accept() (bool, error) {
 
 	clientURL := urlFor(conn.RemoteAddr())
 
+	s.connsMutex.Lock()
+	s.conns[conn] = struct{}{}
+	s.connsMutex.Unlock()
+
 	go func() {
-		if err := s.handleConn(conn); err != nil {
+		defer func() {
+			s.connsMutex.Lock()
+			delete(s.conns, conn)
+			s.connsMutex.Unlock()
+		}()
+		if err := s.handleConn(conn); err != nil && !isClosedNetworkError(errx.Cause(err)) {
 			log.Printf("conn %s: %v", conn.RemoteAddr(), err)
 		}
 		if err := conn.Close(); err != nil {
@@ -221,133 +591,847 @@ func (s *Server) accept() (bool, error) {
 	return false, nil
 }
 
+// session holds the state of a client connection.
+type session struct {
+	user     *User
+	done     bool
+	detached bool
+
+	// version holds the protocol version of the peer. Peers that don't perform a handshake, are
+	// assumed to be of the minimal protocol version.
+	version int
+
+	multi       bool
+	multiFailed bool
+	queued      []queuedCommand
+	watched     map[string]watchedKey
+
+	// writeMutex guards the writer, since events are written concurrently to the replies.
+	writeMutex sync.Mutex
+	observed   map[string]*observation
+	subscriber *subscriber
+}
+
+// canRead returns true, if the session is allowed to read the provided key.
+func (ss *session) canRead(key []byte) bool {
+	return ss.user == nil || ss.user.canAccess(key, false)
+}
+
 func (s *Server) handleConn(conn net.Conn) error {
 	r := redisserver.NewReader(conn)
 	w := redisserver.NewWriter(conn)
 
-	done := false
-	for !done {
+	ss := &session{version: minProtocolVersion}
+	defer func() {
+		ss.writeMutex.Lock()
+		ss.unobserveAll()
+		s.unsubscribeAll(ss)
+		ss.writeMutex.Unlock()
+	}()
+	for !ss.done {
 		cmd, err := r.ReadCommand()
 		if err == io.EOF {
-			done = true
+			ss.done = true
 			continue
 		}
 		if err != nil {
+			if strings.HasPrefix(err.Error(), "Protocol error") {
+				w.WriteError("ERR " + err.Error())
+				w.Flush()
+			}
 			return errx.Annotatef(err, "read command")
 		}
+		if len(cmd.Args) == 0 {
+			continue
+		}
 
 		command := strings.ToLower(string(cmd.Args[0]))
 		arguments := cmd.Args[1:]
 
-		switch command {
-		case cmdHelp:
-			w.WriteBulkString(help)
-		case cmdQuit:
-			done = true
-			w.WriteString("OK")
-		case cmdPing:
-			w.WriteString("OK")
-		case cmdSet:
-			if err := s.store.Set(arguments[0], arguments[1]); err != nil {
-				return errx.Annotatef(err, "set")
+		ss.writeMutex.Lock()
+		err = s.handleCommand(conn, w, ss, command, arguments)
+		ss.writeMutex.Unlock()
+		if err != nil || ss.detached {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleCommand checks and runs the provided command and flushes the reply. A returned error
+// terminates the connection.
+func (s *Server) handleCommand(conn net.Conn, w *redisserver.Writer, ss *session, command string, arguments [][]byte) error {
+	err := s.checkCommand(ss, command, arguments)
+	switch {
+	case err == nil && ss.multi && !multiCommands[command]:
+		if err = ss.queue(command, arguments); err == nil {
+			w.WriteString("QUEUED")
+		}
+		ss.multiFailed = ss.multiFailed || err != nil
+	case err == nil:
+		err = s.execute(conn, w, ss, command, arguments)
+		if ss.detached {
+			return err
+		}
+	case ss.multi:
+		ss.multiFailed = true
+	}
+	if err != nil {
+		w.WriteError(errorReply(err))
+	}
+
+	if err := w.Flush(); err != nil {
+		return errx.Annotatef(err, "flush")
+	}
+	return nil
+}
+
+// execute runs the provided command. A returned error is replied to the client.
+func (s *Server) execute(conn net.Conn, w *redisserver.Writer, ss *session, command string, arguments [][]byte) error {
+	switch command {
+	case cmdHelp:
+		w.WriteBulkString(help)
+	case cmdQuit:
+		ss.done = true
+		w.WriteString("OK")
+	case cmdPing:
+		w.WriteString("OK")
+	case cmdAuth:
+		if len(arguments) > 2 {
+			return errWrongArity(command)
+		}
+		name, password := DefaultUser, string(arguments[len(arguments)-1])
+		if len(arguments) == 2 {
+			name = string(arguments[0])
+		}
+		if !s.authEnabled() {
+			return replyError("ERR AUTH called without any users configured")
+		}
+		user := s.authenticate(name, password)
+		if user == nil {
+			return errWrongPass
+		}
+		ss.user = user
+		w.WriteString("OK")
+	case cmdSet:
+		ttl, condition, err := parseSetOptions(arguments[2:])
+		if err != nil {
+			return err
+		}
+		expiresAt := time.Time{}
+		if ttl > 0 {
+			expiresAt = time.Now().Add(ttl)
+		}
+		ok, err := s.store.set(arguments[0], arguments[1], expiresAt, condition)
+		if err != nil {
+			return errx.Annotatef(err, "set")
+		}
+		if !ok {
+			w.WriteNull()
+			break
+		}
+		w.WriteString("OK")
+	case cmdGetRev:
+		value, revision, err := s.store.GetWithRevision(arguments[0])
+		if err != nil {
+			return errx.Annotatef(err, "get with revision [%s]", arguments[0])
+		}
+		if value == nil {
+			w.WriteNull()
+			break
+		}
+		w.WriteArray(2)
+		w.WriteBulk(value)
+		w.WriteInt64(int64(revision))
+	case cmdCompareSet:
+		revision, err := strconv.ParseUint(string(arguments[1]), 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		ok, err := s.store.CompareAndSet(arguments[0], revision, arguments[2])
+		if err != nil {
+			return errx.Annotatef(err, "compare and set [%s]", arguments[0])
+		}
+		w.WriteInt(boolToInt(ok))
+	case cmdCompareDel:
+		revision, err := strconv.ParseUint(string(arguments[1]), 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		ok, err := s.store.DeleteIfRevision(arguments[0], revision)
+		if err != nil {
+			return errx.Annotatef(err, "delete if revision [%s]", arguments[0])
+		}
+		w.WriteInt(boolToInt(ok))
+	case cmdGet:
+		value, err := s.store.Get(arguments[0])
+		if err != nil {
+			return errx.Annotatef(err, "get [%s]", arguments[0])
+		}
+		writeBulkOrNull(w, value)
+	case cmdDelete:
+		count := 0
+		for _, key := range arguments {
+			ok, err := s.store.delete(key, nil)
+			if err != nil {
+				return errx.Annotatef(err, "delete [%s]", key)
 			}
-			w.WriteString("OK")
-		case cmdGet:
-			value, err := s.store.Get(arguments[0])
+			count += boolToInt(ok)
+		}
+		w.WriteInt(count)
+	case cmdExists:
+		count := 0
+		for _, key := range arguments {
+			value, err := s.store.Get(key)
 			if err != nil {
-				return errx.Annotatef(err, "get [%s]", arguments[0])
+				return errx.Annotatef(err, "get [%s]", key)
 			}
-			w.WriteBulk(value)
-		case cmdDelete:
-			if err := s.store.Delete(arguments[0]); err != nil {
-				return errx.Annotatef(err, "delete [%s]", arguments[0])
+			if value != nil {
+				count++
 			}
-			w.WriteString("OK")
-		case cmdKeys:
-			w.WriteArray(s.store.Len())
-			s.store.Each(func(key, _ []byte) error {
-				w.WriteBulk(key)
-				return nil
-			})
-		case cmdPeerAdd:
-			pingInterval, err := time.ParseDuration(string(arguments[1]))
+		}
+		w.WriteInt(count)
+	case cmdMGet:
+		values := make([][]byte, len(arguments))
+		for index, key := range arguments {
+			value, err := s.store.Get(key)
 			if err != nil {
-				return errx.Annotatef(err, "parse duration [%s]", arguments[1])
+				return errx.Annotatef(err, "get [%s]", key)
 			}
-			reconnectInterval, err := time.ParseDuration(string(arguments[2]))
-			if err != nil {
-				return errx.Annotatef(err, "parse duration [%s]", arguments[2])
+			values[index] = value
+		}
+		w.WriteArray(len(values))
+		for _, value := range values {
+			writeBulkOrNull(w, value)
+		}
+	case cmdMSet:
+		if len(arguments)%2 != 0 {
+			return errWrongArity(command)
+		}
+		if err := s.store.Update(func(tx *Tx) error {
+			for index := 0; index < len(arguments); index += 2 {
+				if err := tx.Set(arguments[index], arguments[index+1]); err != nil {
+					return errx.Annotatef(err, "set [%s]", arguments[index])
+				}
 			}
-			if err := s.AddPeer(string(arguments[0]), pingInterval, reconnectInterval); err != nil {
-				return errx.Annotatef(err, "peer add [%s %s %s]", arguments[0], pingInterval, reconnectInterval)
+			return nil
+		}); err != nil {
+			return errx.Annotatef(err, "update")
+		}
+		w.WriteString("OK")
+	case cmdDBSize:
+		w.WriteInt(s.store.liveLen())
+	case cmdScan:
+		cursor, err := strconv.ParseUint(string(arguments[0]), 10, 64)
+		if err != nil {
+			return replyError("ERR invalid cursor")
+		}
+		pattern, count, err := parseScanOptions(arguments[1:])
+		if err != nil {
+			return err
+		}
+		keys, next := s.store.scan(cursor, count)
+		result := [][]byte{}
+		for _, key := range keys {
+			if ss.canRead(key) && (pattern == nil || matchPattern(pattern, key)) {
+				result = append(result, key)
 			}
-			w.WriteString("OK")
-		case cmdPeerRemove:
-			if err := s.RemovePeer(string(arguments[0])); err != nil {
-				return errx.Annotatef(err, "peer remove [%s]", arguments[0])
+		}
+		w.WriteArray(2)
+		w.WriteBulkString(strconv.FormatUint(next, 10))
+		w.WriteArray(len(result))
+		for _, key := range result {
+			w.WriteBulk(key)
+		}
+	case cmdRange, cmdPrefix:
+		start, end, rest := arguments[0], []byte(nil), arguments[1:]
+		if command == cmdRange {
+			if len(arguments[1]) > 0 {
+				end = arguments[1]
 			}
-			w.WriteString("OK")
-		case cmdPeerList:
-			peerURLs := s.PeerURLs()
-			w.WriteArray(len(peerURLs))
-			for _, peerURL := range peerURLs {
-				w.WriteString(peerURL)
+			rest = arguments[2:]
+		} else {
+			end = prefixEnd(start)
+		}
+		count, reverse, err := parseRangeOptions(rest[1:])
+		if err != nil {
+			return err
+		}
+		keys, next, err := s.scanPage(start, end, rest[0], count, reverse)
+		if err != nil {
+			return errx.Annotatef(err, "scan")
+		}
+		result := [][]byte{}
+		for _, key := range keys {
+			if ss.canRead(key) {
+				result = append(result, key)
 			}
-		case cmdTidy:
-			if err := s.store.Tidy(); err != nil {
-				return errx.Annotatef(err, "tidy")
+		}
+		w.WriteArray(2)
+		w.WriteBulk(next)
+		w.WriteArray(len(result))
+		for _, key := range result {
+			w.WriteBulk(key)
+		}
+	case cmdKeys:
+		if len(arguments) > 1 {
+			return errWrongArity(command)
+		}
+		keys := [][]byte{}
+		s.store.Each(func(key, _ []byte) error {
+			if !ss.canRead(key) || (len(arguments) == 1 && !matchPattern(arguments[0], key)) {
+				return nil
 			}
+			keys = append(keys, key)
+			return nil
+		})
+		w.WriteArray(len(keys))
+		for _, key := range keys {
+			w.WriteBulk(key)
+		}
+	case cmdExpire, cmdPExpire:
+		amount, err := strconv.ParseInt(string(arguments[1]), 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		unit := time.Second
+		if command == cmdPExpire {
+			unit = time.Millisecond
+		}
+		ok, err := s.store.Expire(arguments[0], time.Duration(amount)*unit)
+		if err != nil {
+			return errx.Annotatef(err, "expire [%s]", arguments[0])
+		}
+		w.WriteInt(boolToInt(ok))
+	case cmdTTL:
+		ttl, err := s.store.TTL(arguments[0])
+		if err != nil {
+			return errx.Annotatef(err, "ttl [%s]", arguments[0])
+		}
+		if ttl < 0 {
+			w.WriteInt64(int64(ttl))
+		} else {
+			w.WriteInt64(int64((ttl + time.Second - 1) / time.Second))
+		}
+	case cmdPersist:
+		ok, err := s.store.Persist(arguments[0])
+		if err != nil {
+			return errx.Annotatef(err, "persist [%s]", arguments[0])
+		}
+		w.WriteInt(boolToInt(ok))
+	case cmdMeta:
+		entry, err := s.store.GetWithMeta(arguments[0])
+		if err != nil {
+			return errx.Annotatef(err, "get with meta [%s]", arguments[0])
+		}
+		if entry == nil {
+			w.WriteNull()
+			break
+		}
+		w.WriteArray(10)
+		w.WriteBulkString("revision")
+		w.WriteInt64(int64(entry.Revision))
+		w.WriteBulkString("timestamp")
+		w.WriteBulkString(formatTime(entry.Timestamp))
+		w.WriteBulkString("origin")
+		w.WriteBulkString(entry.Origin)
+		w.WriteBulkString("deleted")
+		w.WriteInt(boolToInt(entry.Deleted))
+		w.WriteBulkString("expires")
+		w.WriteBulkString(formatTime(entry.ExpiresAt))
+	case cmdPeerAdd:
+		pingInterval, err := time.ParseDuration(string(arguments[1]))
+		if err != nil {
+			return errx.Annotatef(err, "parse duration [%s]", arguments[1])
+		}
+		reconnectInterval, err := time.ParseDuration(string(arguments[2]))
+		if err != nil {
+			return errx.Annotatef(err, "parse duration [%s]", arguments[2])
+		}
+		if err := s.AddPeer(string(arguments[0]), pingInterval, reconnectInterval); err != nil {
+			return errx.Annotatef(err, "peer add [%s %s %s]", arguments[0], pingInterval, reconnectInterval)
+		}
+		w.WriteString("OK")
+	case cmdPeerRemove:
+		if err := s.RemovePeer(string(arguments[0])); err != nil {
+			return errx.Annotatef(err, "peer remove [%s]", arguments[0])
+		}
+		w.WriteString("OK")
+	case cmdPeerList:
+		peerURLs := s.PeerURLs()
+		w.WriteArray(len(peerURLs))
+		for _, peerURL := range peerURLs {
+			w.WriteString(peerURL)
+		}
+	case cmdTidy:
+		if err := s.store.Tidy(); err != nil {
+			return errx.Annotatef(err, "tidy")
+		}
+		w.WriteString("OK")
+	case cmdInfo:
+		if len(arguments) > 1 {
+			return errSyntax
+		}
+		section := ""
+		if len(arguments) == 1 {
+			section = strings.ToLower(string(arguments[0]))
+		}
+		w.WriteBulkString(s.info(section))
+	case cmdEcho:
+		w.WriteBulk(arguments[0])
+	case cmdSelect:
+		index, err := strconv.Atoi(string(arguments[0]))
+		if err != nil {
+			return errNotInteger
+		}
+		if index != 0 {
+			return replyError("ERR DB index is out of range")
+		}
+		w.WriteString("OK")
+	case cmdCommand:
+		if err := writeCommandInfo(w, arguments); err != nil {
+			return err
+		}
+	case cmdMulti:
+		if ss.multi {
+			return replyError("ERR MULTI calls can not be nested")
+		}
+		ss.multi = true
+		w.WriteString("OK")
+	case cmdExec:
+		if !ss.multi {
+			return replyError("ERR EXEC without MULTI")
+		}
+		queued, failed, watched := ss.queued, ss.multiFailed, ss.watched
+		ss.resetMulti()
+		if failed {
+			return replyError("EXECABORT Transaction discarded because of previous errors.")
+		}
+		return s.exec(w, queued, watched)
+	case cmdDiscard:
+		if !ss.multi {
+			return replyError("ERR DISCARD without MULTI")
+		}
+		ss.resetMulti()
+		w.WriteString("OK")
+	case cmdWatch:
+		if ss.multi {
+			return replyError("ERR WATCH inside MULTI is not allowed")
+		}
+		ss.watch(s.store, arguments)
+		w.WriteString("OK")
+	case cmdUnwatch:
+		ss.watched = nil
+		w.WriteString("OK")
+	case cmdObserve:
+		for _, prefix := range arguments {
+			s.observe(conn, w, ss, prefix)
+		}
+	case cmdUnobserve:
+		ss.unobserve(w, arguments)
+	case cmdPublish:
+		w.WriteInt(s.Publish(arguments[0], arguments[1]))
+	case cmdSubscribe, cmdPSubscribe:
+		s.subscribe(conn, w, ss, command, arguments)
+	case cmdUnsubscribe, cmdPUnsubscribe:
+		s.unsubscribe(w, ss, command, arguments)
+	case cmdPeerPublish:
+		id, err := parseMessageID(arguments[0])
+		if err != nil {
+			return err
+		}
+		hops, err := strconv.Atoi(string(arguments[1]))
+		if err != nil {
+			return errNotInteger
+		}
+		s.relayMessage(message{id: id, hops: hops, channel: arguments[2], payload: arguments[3]})
+		w.WriteString("OK")
+	case cmdMembers:
+		members := s.Members()
+		w.WriteArray(len(members))
+		for _, m := range members {
+			w.WriteArray(3)
+			w.WriteBulkString(m.URL)
+			w.WriteBulkString(m.State.String())
+			w.WriteInt64(int64(m.Incarnation))
+		}
+	case cmdSetContainer:
+		kh, err := parseKeyHash(arguments[0])
+		if err != nil {
+			return err
+		}
+		updates := make([]containerUpdate, len(arguments)-1)
+		for index, argument := range arguments[1:] {
+			updates[index] = containerUpdate{keyHash: kh, bytes: argument}
+		}
+		applied, err := s.store.setContainers(updates)
+		if err != nil {
+			return errx.Annotatef(err, "set container [%s]", kh)
+		}
+		if ss.version < 2 {
 			w.WriteString("OK")
-		case cmdSetContainer:
-			kh := keyHash{}
-			copy(kh[:], arguments[0][:keyHashSize])
-			if err := s.store.setContainer(kh, arguments[1]); err != nil {
-				return errx.Annotatef(err, "set container [%s]", kh)
+		} else {
+			// peers of protocol version 2 get the number of applied containers.
+			w.WriteInt(len(applied))
+		}
+	case cmdGetContainer:
+		kh, err := parseKeyHash(arguments[0])
+		if err != nil {
+			return err
+		}
+		containers, err := s.store.getContainers(kh, containerVersion(ss.version))
+		if err != nil {
+			return errx.Annotatef(err, "get containers [%s]", kh)
+		}
+		if ss.version < 2 {
+			// peers of protocol version 1 expect a single container per key hash.
+			var c []byte
+			if len(containers) > 0 {
+				c = containers[0]
 			}
-			w.WriteString("OK")
-		case cmdGetContainer:
-			kh := keyHash{}
-			copy(kh[:], arguments[0][:keyHashSize])
-			c, err := s.store.getContainer(kh)
+			w.WriteBulk(c)
+		} else {
+			w.WriteArray(len(containers))
+			for _, c := range containers {
+				w.WriteBulk(c)
+			}
+		}
+	case cmdSetBatch:
+		if len(arguments)%3 != 0 {
+			return errx.BadRequestf("expected triples of key hash, hops and container, got %d arguments", len(arguments))
+		}
+		updates := make([]containerUpdate, len(arguments)/3)
+		for index := range updates {
+			kh, err := parseKeyHash(arguments[3*index])
 			if err != nil {
-				return errx.Annotatef(err, "get container [%s]", kh)
+				return err
 			}
-			w.WriteBulk(c)
-		case cmdReconcilate:
-			w.WriteString("OK")
-			if err := w.Flush(); err != nil {
-				return errx.Annotatef(err, "flush")
+			updates[index].keyHash = kh
+			hops, err := strconv.Atoi(string(arguments[3*index+1]))
+			if err != nil {
+				return errNotInteger
+			}
+			updates[index].hops = hops
+			updates[index].bytes = arguments[3*index+2]
+		}
+		applied, err := s.store.setContainers(updates)
+		if err != nil {
+			return errx.Annotatef(err, "set containers")
+		}
+		s.relay(applied)
+		w.WriteString("OK")
+	case cmdGetBatch:
+		buckets := make([][][]byte, len(arguments))
+		for index, argument := range arguments {
+			kh, err := parseKeyHash(argument)
+			if err != nil {
+				return err
 			}
-			if err := s.peer.Accept(conn); err != nil {
-				return errx.Annotatef(err, "recon accept")
+			containers, err := s.store.getContainers(kh, containerVersion(ss.version))
+			if err != nil {
+				return errx.Annotatef(err, "get containers [%s]", kh)
 			}
-			return nil // exit command loop
-		default:
-			w.WriteError(fmt.Sprintf("unknown command [%s]", command))
+			buckets[index] = containers
 		}
-
+		w.WriteArray(len(buckets))
+		for _, containers := range buckets {
+			w.WriteArray(len(containers))
+			for _, c := range containers {
+				w.WriteBulk(c)
+			}
+		}
+	case cmdGetRevisions:
+		w.WriteArray(len(arguments))
+		for _, key := range arguments {
+			if revision, ok := s.store.getRevision(key); ok {
+				w.WriteInt64(int64(revision))
+			} else {
+				w.WriteInt(-1)
+			}
+		}
+	case cmdMemberPing:
+		if !s.membershipEnabled() {
+			return errMembershipDisabled
+		}
+		members, err := parseMemberArguments(arguments)
+		if err != nil {
+			return errx.Annotatef(err, "parse members")
+		}
+		s.applyMembers(members)
+		members = s.membership.list()
+		w.WriteArray(3 * len(members))
+		for _, argument := range memberArguments(members) {
+			w.WriteBulkString(argument.(string))
+		}
+	case cmdMemberPingRq:
+		if !s.membershipEnabled() {
+			return errMembershipDisabled
+		}
+		members, err := parseMemberArguments(arguments[1:])
+		if err != nil {
+			return errx.Annotatef(err, "parse members")
+		}
+		s.applyMembers(members)
+		w.WriteInt(boolToInt(s.probe(string(arguments[0])) == nil))
+	case cmdHello:
+		remote, err := parseHandshake(arguments)
+		if err != nil {
+			return err
+		}
+		local := s.handshake()
+		version, err := local.check(remote)
+		if err != nil {
+			ss.done = true
+			return err
+		}
+		ss.version = version
+		w.WriteArray(3)
+		for _, argument := range local.arguments() {
+			w.WriteBulkString(argument.(string))
+		}
+	case cmdReconcilate:
+		w.WriteString("OK")
 		if err := w.Flush(); err != nil {
 			return errx.Annotatef(err, "flush")
 		}
+		ss.detached = true // exit command loop
+		if err := s.newReconPeer().Accept(conn); err != nil {
+			return errx.Annotatef(err, "recon accept")
+		}
 	}
 
 	return nil
 }
 
-func (s *Server) update(kh keyHash, container *container) {
+func (s *Server) update(changes []change) {
+	s.streamsMutex.RLock()
+	for _, stream := range s.streams {
+		stream.update(changes)
+	}
+	s.streamsMutex.RUnlock()
+}
+
+// relay passes the provided containers, that have been received from a peer, on to all peers,
+// unless they have reached the hop limit.
+func (s *Server) relay(containers []container) {
+	s.streamsMutex.RLock()
+	defer s.streamsMutex.RUnlock()
+	changes := []change{}
+	for index := range containers {
+		c := containers[index]
+		if c.hops >= s.relayHops {
+			continue
+		}
+		c.hops++
+		changes = append(changes, change{keyHash: s.store.keyHashFn(c.key), container: &c})
+	}
+	if len(changes) == 0 {
+		return
+	}
+	for _, stream := range s.streams {
+		stream.update(changes)
+	}
+}
+
+// newReconPeer returns a recon peer on a snapshot of the store's state, so the reconciliation
+// doesn't interfere with concurrent writes.
+func (s *Server) newReconPeer() *recon.Peer {
+	return recon.NewPeer(recon.DefaultSettings(), s.store.stateSnapshot().prefixTree())
+}
+
+// acknowledged returns true if all peers have acknowledged the provided revision of the key. As
+// long as a known member isn't a peer, nothing is acknowledged, since that member might still hold
+// an older revision of the key.
+func (s *Server) acknowledged(key []byte, revision uint64) bool {
+	urls := s.membership.urls()
+	s.streamsMutex.RLock()
+	defer s.streamsMutex.RUnlock()
+	for _, url := range urls {
+		if _, ok := s.streams[url]; !ok {
+			return false
+		}
+	}
+	for _, stream := range s.streams {
+		if !stream.acknowledged(key, revision) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) purged(key []byte) {
 	s.streamsMutex.RLock()
 	for _, stream := range s.streams {
-		stream.update(kh, container)
+		stream.forget(key)
 	}
 	s.streamsMutex.RUnlock()
 }
 
-func parseURL(u string) (string, string, error) {
+func parseSetOptions(arguments [][]byte) (time.Duration, writeCondition, error) {
+	ttl := time.Duration(0)
+	var condition writeCondition
+	for index := 0; index < len(arguments); index++ {
+		option := strings.ToLower(string(arguments[index]))
+		switch option {
+		case "nx", "xx":
+			if condition != nil {
+				return 0, nil, errSyntax
+			}
+			if option == "nx" {
+				condition = absentCondition
+			} else {
+				condition = presentCondition
+			}
+		case "ex", "px":
+			if index+1 >= len(arguments) {
+				return 0, nil, errSyntax
+			}
+			index++
+			value, err := strconv.ParseInt(string(arguments[index]), 10, 64)
+			if err != nil {
+				return 0, nil, errNotInteger
+			}
+			if value <= 0 {
+				return 0, nil, replyError("ERR invalid expire time in 'set' command")
+			}
+			if option == "ex" {
+				ttl = time.Duration(value) * time.Second
+			} else {
+				ttl = time.Duration(value) * time.Millisecond
+			}
+		default:
+			return 0, nil, errSyntax
+		}
+	}
+	return ttl, condition, nil
+}
+
+// parseScanOptions returns the pattern and the count of a scan command. If no pattern is
+// provided, nil is returned.
+func parseScanOptions(arguments [][]byte) ([]byte, int, error) {
+	pattern, count := []byte(nil), 10
+	for index := 0; index < len(arguments); index += 2 {
+		if index+1 >= len(arguments) {
+			return nil, 0, errSyntax
+		}
+		switch strings.ToLower(string(arguments[index])) {
+		case "match":
+			pattern = arguments[index+1]
+		case "count":
+			value, err := strconv.Atoi(string(arguments[index+1]))
+			if err != nil {
+				return nil, 0, errNotInteger
+			}
+			if value < 1 {
+				return nil, 0, errSyntax
+			}
+			count = value
+		default:
+			return nil, 0, errSyntax
+		}
+	}
+	return pattern, count, nil
+}
+
+// parseRangeOptions returns the count and the order of a range or prefix command.
+func parseRangeOptions(arguments [][]byte) (int, bool, error) {
+	count, reverse := 10, false
+	for index := 0; index < len(arguments); index++ {
+		switch strings.ToLower(string(arguments[index])) {
+		case "count":
+			if index+1 >= len(arguments) {
+				return 0, false, errSyntax
+			}
+			index++
+			value, err := strconv.Atoi(string(arguments[index]))
+			if err != nil {
+				return 0, false, errNotInteger
+			}
+			if value < 1 {
+				return 0, false, errSyntax
+			}
+			count = value
+		case "rev":
+			reverse = true
+		default:
+			return 0, false, errSyntax
+		}
+	}
+	return count, reverse, nil
+}
+
+// scanPage returns up to count keys with start <= key < end, that follow the provided cursor.
+// The returned cursor has to be passed to fetch the next page. If all keys have been returned,
+// the cursor is empty. In ascending order, the cursor is the first key of the next page, in
+// descending order, it's the last key of the current page.
+func (s *Server) scanPage(start, end, cursor []byte, count int, reverse bool) ([][]byte, []byte, error) {
+	if len(cursor) > 0 {
+		if reverse && (end == nil || bytes.Compare(cursor, end) < 0) {
+			end = cursor
+		}
+		if !reverse && bytes.Compare(cursor, start) > 0 {
+			start = cursor
+		}
+	}
+
+	keys, next := [][]byte{}, []byte{}
+	errPageFull := errx.Errorf("page full")
+	fn := func(key, _ []byte) error {
+		if len(keys) == count {
+			if reverse {
+				next = keys[len(keys)-1]
+			} else {
+				next = key
+			}
+			return errPageFull
+		}
+		keys = append(keys, key)
+		return nil
+	}
+	scan := s.store.Scan
+	if reverse {
+		scan = s.store.ScanReverse
+	}
+	if err := scan(start, end, fn); err != nil && err != errPageFull {
+		return nil, nil, err
+	}
+	return keys, next, nil
+}
+
+func writeBulkOrNull(w *redisserver.Writer, value []byte) {
+	if value == nil {
+		w.WriteNull()
+		return
+	}
+	w.WriteBulk(value)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// parseURL returns the network and the address of the provided url. Urls with the scheme 'tls'
+// are tcp addresses, that are secured by tls.
+func parseURL(u string) (string, string, bool, error) {
 	url, err := url.Parse(u)
 	if err != nil {
-		return "", "", errx.Annotatef(err, "parse url [%s]", u)
+		return "", "", false, errx.Annotatef(err, "parse url [%s]", u)
+	}
+	if url.Scheme == schemeTLS {
+		return "tcp", url.Host, true, nil
 	}
-	return url.Scheme, url.Host, nil
+	return url.Scheme, url.Host, false, nil
 }
 
 func urlFor(addr net.Addr) string {
@@ -360,3 +1444,49 @@ func isClosedNetworkError(err error) bool {
 	}
 	return false
 }
+
+// info returns information about the node in the format of the redis INFO command. If a section
+// is provided, only that section is returned.
+func (s *Server) info(section string) string {
+	s.connsMutex.Lock()
+	clients := len(s.conns)
+	s.connsMutex.Unlock()
+	handshake := s.handshake()
+
+	sections := []struct {
+		title  string
+		fields [][2]string
+	}{
+		{"Server", [][2]string{
+			{"node_id", handshake.nodeID.String()},
+			{"cluster_name", handshake.clusterName},
+			{"protocol_version", strconv.Itoa(handshake.version)},
+			{"listen_url", s.ListenURL()},
+		}},
+		{"Clients", [][2]string{
+			{"connected_clients", strconv.Itoa(clients)},
+		}},
+		{"Replication", [][2]string{
+			{"connected_peers", strconv.Itoa(len(s.PeerURLs()))},
+			{"members", strconv.Itoa(len(s.Members()))},
+		}},
+		{"Keyspace", [][2]string{
+			{"db0", fmt.Sprintf("keys=%d,deleted=%d", s.store.liveLen(), s.store.DeletedLen())},
+		}},
+	}
+
+	b := strings.Builder{}
+	for _, sect := range sections {
+		if section != "" && section != "all" && section != strings.ToLower(sect.title) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + sect.title + "\r\n")
+		for _, field := range sect.fields {
+			b.WriteString(field[0] + ":" + field[1] + "\r\n")
+		}
+	}
+	return b.String()
+}
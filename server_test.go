@@ -1,7 +1,9 @@
 package deks_test
 
 import (
+	"fmt"
 	"math/rand"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -67,6 +69,211 @@ func TestServerReconcilateUpdatedValue(t *testing.T) {
 	assert.Equal(t, testAnotherValue, value)
 }
 
+func TestServerReconcilateExpiry(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeOne.SetWithTTL(testKey, testValue, time.Minute))
+
+	_, err := e.serverTwo.Reconcilate(e.serverOne.ListenURL())
+	require.NoError(t, err)
+
+	ttl, err := e.storeTwo.TTL(testKey)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute, ttl, float64(time.Second))
+}
+
+func TestServerReconcilateKeyHashCollision(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	deks.SetKeyHashFunc(e.storeOne, collidingKeyHash)
+	deks.SetKeyHashFunc(e.storeTwo, collidingKeyHash)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeOne.Set(testAnotherKey, testAnotherValue))
+	require.NoError(t, e.storeTwo.Set(testKey, testValue))
+
+	count, err := e.serverTwo.Reconcilate(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	require.Equal(t, 2, e.storeTwo.Len())
+	value, err := e.storeTwo.Get(testAnotherKey)
+	require.NoError(t, err)
+	assert.Equal(t, testAnotherValue, value)
+	assert.Equal(t, e.storeOne.State().Items(), e.storeTwo.State().Items())
+}
+
+func TestServerReconcilateKeepsMeta(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+
+	_, err := e.serverTwo.Reconcilate(e.serverOne.ListenURL())
+	require.NoError(t, err)
+
+	expected, err := e.storeOne.GetWithMeta(testKey)
+	require.NoError(t, err)
+	entry, err := e.storeTwo.GetWithMeta(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, expected, entry)
+	assert.Equal(t, e.storeOne.NodeID(), entry.Origin)
+}
+
+func TestServerReconcilatePeers(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeTwo.Set(testKey, testValue))
+	require.NoError(t, e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, time.Minute))
+
+	count, err := e.serverOne.ReconcilatePeers(0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	value, err := e.storeOne.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+}
+
+func TestServerReconcilateBidirectional(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeTwo.Set(testAnotherKey, testAnotherValue))
+
+	pulled, pushed, err := e.serverOne.ReconcilateBidirectional(e.serverTwo.ListenURL())
+	require.NoError(t, err)
+	assert.Equal(t, 1, pulled)
+	assert.Equal(t, 1, pushed)
+
+	value, err := e.storeOne.Get(testAnotherKey)
+	require.NoError(t, err)
+	assert.Equal(t, testAnotherValue, value)
+
+	value, err = e.storeTwo.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+}
+
+func TestServerReconcilateBidirectionalManyKeys(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	for index := 0; index < 500; index++ {
+		key := []byte(fmt.Sprintf("key-%d", index))
+		require.NoError(t, e.storeOne.Set(key, testValue))
+		require.NoError(t, e.storeTwo.Set(key, testValue))
+	}
+	for index := 0; index < 50; index++ {
+		require.NoError(t, e.storeOne.Set([]byte(fmt.Sprintf("one-%d", index)), testValue))
+		require.NoError(t, e.storeTwo.Set([]byte(fmt.Sprintf("two-%d", index)), testValue))
+	}
+
+	pulled, pushed, err := e.serverOne.ReconcilateBidirectional(e.serverTwo.ListenURL())
+	require.NoError(t, err)
+	assert.Equal(t, 50, pulled)
+	assert.Equal(t, 50, pushed)
+
+	assert.Equal(t, 600, e.storeOne.Len())
+	assert.Equal(t, 600, e.storeTwo.Len())
+}
+
+func TestServerReconcilateBidirectionalPushesNewerValue(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeTwo.Set(testKey, testValue))
+	require.NoError(t, e.storeTwo.Set(testKey, testAnotherValue))
+
+	_, pushed, err := e.serverTwo.ReconcilateBidirectional(e.serverOne.ListenURL())
+	require.NoError(t, err)
+	assert.Equal(t, 1, pushed)
+
+	for _, store := range []*deks.Store{e.storeOne, e.storeTwo} {
+		value, err := store.Get(testKey)
+		require.NoError(t, err)
+		assert.Equal(t, testAnotherValue, value)
+	}
+}
+
+// reconcilationMetric records the number of repaired keys of all reconciliations.
+type reconcilationMetric struct {
+	*deks.MetricMock
+	repairedCount int
+	mutex         sync.Mutex
+}
+
+func (rm *reconcilationMetric) Reconcilated(_ string, repairedCount int) {
+	rm.mutex.Lock()
+	rm.repairedCount += repairedCount
+	rm.mutex.Unlock()
+}
+
+func TestServerReconcilateCountsRepairedKeys(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	m := &reconcilationMetric{MetricMock: deks.NewMetricMock()}
+	store := deks.NewStore(m)
+	server, err := deks.NewServer(store, "tcp://localhost:0", m)
+	require.NoError(t, err)
+	defer server.Close()
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, store.Set(testKey, testValue))
+	require.NoError(t, store.Set(testKey, testAnotherValue))
+
+	_, _, err = server.ReconcilateBidirectional(e.serverOne.ListenURL())
+	require.NoError(t, err)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	assert.Equal(t, 1, m.repairedCount)
+}
+
+func TestServerReconcilateInBatches(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	for index := 0; index < 10; index++ {
+		require.NoError(t, e.storeTwo.Set([]byte(fmt.Sprintf("key-%d", index)), testValue))
+	}
+	e.serverOne.SetReconcileBatching(3, 2)
+
+	count, err := e.serverOne.Reconcilate(e.serverTwo.ListenURL())
+	require.NoError(t, err)
+	assert.Equal(t, 10, count)
+	assert.Equal(t, 10, e.storeOne.Len())
+}
+
+func TestServerReconcilateOnStreamReconnect(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	listenURL := e.serverTwo.ListenURL()
+	require.NoError(t, e.serverOne.AddPeer(listenURL, 20*time.Millisecond, 20*time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, e.serverTwo.Close())
+	time.Sleep(50 * time.Millisecond)
+
+	storeThree := deks.NewStore(e.metric)
+	require.NoError(t, storeThree.Set(testKey, testValue))
+	serverThree, err := deks.NewServer(storeThree, listenURL, e.metric)
+	require.NoError(t, err)
+	defer serverThree.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	value, err := e.storeOne.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+}
+
 func TestServerStreamUpdatesToAnotherNode(t *testing.T) {
 	e := setUpTestEnvironment(t)
 	defer e.tearDown()
@@ -83,6 +290,69 @@ func TestServerStreamUpdatesToAnotherNode(t *testing.T) {
 	assert.Equal(t, testValue, value)
 }
 
+func TestServerStreamUpdatesBatchToAnotherNode(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, time.Minute)
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Update(func(tx *deks.Tx) error {
+		require.NoError(t, tx.Set(testKey, testValue))
+		return tx.Set(testAnotherKey, testValue)
+	}))
+	time.Sleep(100 * time.Millisecond)
+
+	require.Equal(t, 2, e.storeTwo.Len())
+	value, err := e.storeTwo.Get(testAnotherKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+}
+
+func TestServerStreamUpdatesFireWatchEvents(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	events, cancel := e.storeTwo.Watch(nil)
+	defer cancel()
+
+	e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, time.Minute)
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+
+	select {
+	case event := <-events:
+		assert.Equal(t, deks.Event{Type: deks.EventSet, Key: testKey, Value: testValue, Remote: true}, event)
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+func TestServerForwardsMessagesToPeers(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverOne.SetMessageForwarding(true)
+	e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, time.Minute)
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := deks.Dial(e.serverTwo.ListenURL())
+	require.NoError(t, err)
+	messages, cancel, err := conn.Subscribe(testKey)
+	require.NoError(t, err)
+	defer cancel()
+
+	assert.Equal(t, 0, e.serverOne.Publish(testKey, testValue))
+
+	select {
+	case m := <-messages:
+		assert.Equal(t, deks.Message{Channel: testKey, Payload: testValue}, m)
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+}
+
 func TestServerStreamUpdatesToTwoOtherNodes(t *testing.T) {
 	e := setUpTestEnvironment(t)
 	defer e.tearDown()
@@ -109,6 +379,115 @@ func TestServerStreamUpdatesToTwoOtherNodes(t *testing.T) {
 	assert.Equal(t, testValue, value)
 }
 
+func TestServerStreamRelaysUpdates(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		relayHops     int
+		expectedCount int
+	}{
+		{"Disabled", 0, 0},
+		{"Enabled", 1, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := setUpTestEnvironment(t)
+			defer e.tearDown()
+
+			storeThree := deks.NewStore(e.metric)
+			serverThree, err := deks.NewServer(storeThree, "tcp://localhost:0", e.metric)
+			require.NoError(t, err)
+			defer serverThree.Close()
+
+			e.serverTwo.SetRelayHops(tc.relayHops)
+			require.NoError(t, e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, time.Minute))
+			require.NoError(t, e.serverTwo.AddPeer(serverThree.ListenURL(), time.Minute, time.Minute))
+			time.Sleep(100 * time.Millisecond)
+
+			require.NoError(t, e.storeOne.Set(testKey, testValue))
+			time.Sleep(100 * time.Millisecond)
+
+			assert.Equal(t, 1, e.storeTwo.Len())
+			assert.Equal(t, tc.expectedCount, storeThree.Len())
+		})
+	}
+}
+
+func TestServerStreamRelaysUpdatesInRing(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	storeThree := deks.NewStore(e.metric)
+	serverThree, err := deks.NewServer(storeThree, "tcp://localhost:0", e.metric)
+	require.NoError(t, err)
+	defer serverThree.Close()
+
+	for _, server := range []*deks.Server{e.serverOne, e.serverTwo, serverThree} {
+		server.SetRelayHops(10)
+	}
+	require.NoError(t, e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, time.Minute))
+	require.NoError(t, e.serverTwo.AddPeer(serverThree.ListenURL(), time.Minute, time.Minute))
+	require.NoError(t, serverThree.AddPeer(e.serverOne.ListenURL(), time.Minute, time.Minute))
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeOne.Set(testKey, testAnotherValue))
+	time.Sleep(100 * time.Millisecond)
+
+	for _, store := range []*deks.Store{e.storeOne, e.storeTwo, storeThree} {
+		entry, err := store.GetWithMeta(testKey)
+		require.NoError(t, err)
+		require.NotNil(t, entry)
+		assert.Equal(t, testAnotherValue, entry.Value)
+		assert.Equal(t, uint64(1), entry.Revision)
+	}
+}
+
+func TestServerStreamIgnoresStaleUpdates(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeTwo.Set(testKey, testValue))
+	require.NoError(t, e.storeTwo.Set(testKey, testAnotherValue))
+
+	e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, time.Minute)
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	time.Sleep(100 * time.Millisecond)
+
+	value, err := e.storeTwo.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testAnotherValue, value)
+}
+
+func TestServerStreamConcurrentUpdatesConverge(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, time.Minute)
+	e.serverTwo.AddPeer(e.serverOne.ListenURL(), time.Minute, time.Minute)
+	time.Sleep(100 * time.Millisecond)
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		require.NoError(t, e.storeOne.Set(testKey, testValue))
+		wg.Done()
+	}()
+	go func() {
+		require.NoError(t, e.storeTwo.Set(testKey, testAnotherValue))
+		wg.Done()
+	}()
+	wg.Wait()
+	time.Sleep(100 * time.Millisecond)
+
+	valueOne, err := e.storeOne.Get(testKey)
+	require.NoError(t, err)
+	valueTwo, err := e.storeTwo.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, valueOne, valueTwo)
+	assert.Equal(t, e.storeOne.State().Items(), e.storeTwo.State().Items())
+}
+
 func TestServerStreamUpdatesToAFailingNode(t *testing.T) {
 	e := setUpTestEnvironment(t)
 	defer e.tearDown()
@@ -125,6 +504,167 @@ func TestServerStreamUpdatesToAFailingNode(t *testing.T) {
 	assert.Equal(t, 0, e.storeTwo.Len())
 }
 
+func TestServerStreamBatchesUpdates(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		size   int
+		linger time.Duration
+	}{
+		{"Immediate", deks.DefaultPeerBatchSize, 0},
+		{"BySize", 1, time.Minute},
+		{"ByLinger", deks.DefaultPeerBatchSize, 20 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := setUpTestEnvironment(t)
+			defer e.tearDown()
+
+			e.serverOne.SetPeerBatching(tc.size, tc.linger)
+			require.NoError(t, e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, time.Minute))
+			time.Sleep(20 * time.Millisecond)
+
+			for index := 0; index < 100; index++ {
+				require.NoError(t, e.storeOne.Set([]byte(fmt.Sprintf("key-%d", index)), testValue))
+			}
+			require.NoError(t, e.storeOne.Delete([]byte("key-0")))
+			time.Sleep(100 * time.Millisecond)
+
+			assert.Equal(t, 99, e.storeTwo.Len())
+			assert.Equal(t, 1, e.storeTwo.DeletedLen())
+		})
+	}
+}
+
+func TestServerStreamDoesNotBlockOnStalledPeer(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	e.serverOne.SetPeerQueue(2, deks.OverflowDrop, 0)
+	require.NoError(t, e.serverOne.AddPeer("tcp://"+l.Addr().String(), time.Minute, time.Minute))
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		for index := 0; index < 100; index++ {
+			require.NoError(t, e.storeOne.Set([]byte(fmt.Sprintf("key-%d", index)), testValue))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writes are blocked by stalled peer")
+	}
+}
+
+func TestServerStreamBlockingQueueDoesNotLockStore(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	e.serverOne.SetPeerQueue(1, deks.OverflowBlock, time.Minute)
+	require.NoError(t, e.serverOne.AddPeer("tcp://"+l.Addr().String(), time.Minute, time.Minute))
+	time.Sleep(20 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	go e.storeOne.Set(testAnotherKey, testValue)
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		value, err := e.storeOne.Get(testAnotherKey)
+		assert.NoError(t, err)
+		assert.Equal(t, testValue, value)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("store is locked by blocked peer queue")
+	}
+}
+
+func TestServerTidyKeepsUnacknowledgedTombstones(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	listenURL := e.serverTwo.ListenURL()
+	require.NoError(t, e.serverTwo.Close())
+
+	e.serverOne.AddPeer(listenURL, time.Minute, time.Minute)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeOne.Delete(testKey))
+
+	require.NoError(t, e.storeOne.Tidy())
+
+	assert.Equal(t, 1, e.storeOne.DeletedLen())
+}
+
+func TestServerTidyPurgesAcknowledgedTombstones(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeTwo.Set(testKey, testValue))
+	require.NoError(t, e.storeOne.Delete(testKey))
+
+	e.serverOne.AddPeer(e.serverTwo.ListenURL(), time.Minute, time.Minute)
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, 0, e.storeTwo.Len())
+	assert.Equal(t, 1, e.storeTwo.DeletedLen())
+
+	require.NoError(t, e.storeOne.Tidy())
+
+	assert.Equal(t, 0, e.storeOne.DeletedLen())
+}
+
+func TestServerTidyPurgesReceivedTombstones(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.serverOne.AddPeer(e.serverTwo.ListenURL(), 10*time.Millisecond, time.Minute)
+	e.serverTwo.AddPeer(e.serverOne.ListenURL(), 10*time.Millisecond, time.Minute)
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeOne.Delete(testKey))
+	time.Sleep(100 * time.Millisecond)
+
+	require.Equal(t, 1, e.storeTwo.DeletedLen())
+
+	require.NoError(t, e.storeTwo.Tidy())
+
+	assert.Equal(t, 0, e.storeTwo.DeletedLen())
+}
+
 func TestServerConcurrentStreamAddAndRemove(t *testing.T) {
 	e := setUpTestEnvironment(t)
 	defer e.tearDown()
@@ -153,3 +693,47 @@ func TestServerConcurrentStreamAddAndRemove(t *testing.T) {
 
 	wg.Wait()
 }
+
+func BenchmarkServerFetchContainers(b *testing.B) {
+	b.Run("PerKey", func(b *testing.B) {
+		e := setUpTestEnvironment(b)
+		defer e.tearDown()
+
+		keys := make([][]byte, 1000)
+		for index := range keys {
+			keys[index] = []byte(fmt.Sprintf("key-%d", index))
+			require.NoError(b, e.storeTwo.Set(keys[index], testValue))
+		}
+
+		b.ResetTimer()
+		for index := 0; index < b.N; index++ {
+			require.NoError(b, deks.FetchContainersPerKey(e.serverOne, e.serverTwo.ListenURL(), keys))
+		}
+	})
+
+	for _, bc := range []struct {
+		name        string
+		batchSize   int
+		parallelism int
+	}{
+		{"Sequential", 1, 1},
+		{"Batched", deks.DefaultReconcileBatchSize, deks.DefaultReconcileParallelism},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			e := setUpTestEnvironment(b)
+			defer e.tearDown()
+
+			keys := make([][]byte, 1000)
+			for index := range keys {
+				keys[index] = []byte(fmt.Sprintf("key-%d", index))
+				require.NoError(b, e.storeTwo.Set(keys[index], testValue))
+			}
+			e.serverOne.SetReconcileBatching(bc.batchSize, bc.parallelism)
+
+			b.ResetTimer()
+			for index := 0; index < b.N; index++ {
+				require.NoError(b, deks.FetchContainers(e.serverOne, e.serverTwo.ListenURL(), keys))
+			}
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package deks
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/simia-tech/errx"
@@ -12,6 +14,14 @@ import (
 
 const keyHashSize = 8
 
+const (
+	// TTLNotExisting is returned by TTL if no value exists at the key.
+	TTLNotExisting time.Duration = -2
+
+	// TTLNotSet is returned by TTL if the value at the key doesn't expire.
+	TTLNotSet time.Duration = -1
+)
+
 type keyHash [keyHashSize]byte
 
 func newKeyHash(data []byte) keyHash {
@@ -24,140 +34,566 @@ func (kh keyHash) String() string {
 	return hex.EncodeToString(kh[:])
 }
 
+// change defines a changed container together with it's key hash.
+type change struct {
+	keyHash   keyHash
+	container *container
+}
+
+// containerUpdate defines a marshaled container together with it's key hash.
+type containerUpdate struct {
+	keyHash keyHash
+	bytes   []byte
+	hops    int
+}
+
 // Store defines a key-value store.
 type Store struct {
 	metric            Metric
-	containers        map[keyHash]*container
+	containers        map[keyHash]bucket
 	containersRWMutex sync.RWMutex
+	index             *keyIndex
+	bucketIndex       *keyIndex
 	state             *Set
 	count             int
 	deletedCount      int
-	updateFn          func(keyHash, *container)
+	keyHashFn         func([]byte) keyHash
+	nodeID            nodeID
+	clock             *clock
+	resolvers         []prefixResolver
+	updateFn          func([]change)
+	pendingUpdates    [][]change
+	watchers          watchers
+	acknowledgedFn    func([]byte, uint64) bool
+	purgedFn          func([]byte)
+	tombstoneCount    uint64
+	journal           *journal
+	gracePeriod       time.Duration
+}
+
+type tombstone struct {
+	key      []byte
+	revision uint64
 }
 
 // NewStore returns a new store.
 func NewStore(m Metric) *Store {
 	return &Store{
 		metric:       m,
-		containers:   make(map[keyHash]*container),
+		containers:   make(map[keyHash]bucket),
+		index:        newKeyIndex(),
+		bucketIndex:  newKeyIndex(),
 		state:        NewSet(),
 		count:        0,
 		deletedCount: 0,
+		keyHashFn:    hashKey,
+		nodeID:       newNodeID(),
+		clock:        &clock{},
 	}
 }
 
-// Set sets the provided value at the provided key.
-func (s *Store) Set(key, value []byte) error {
-	kh := hashKey(key)
-	s.containersRWMutex.Lock()
-	if c, ok := s.containers[kh]; ok {
-		s.state.Remove(stateItem(kh, c.revision))
-		c.value = value
-		c.revision++
-		if c.isDeleted() {
-			c.undelete()
-			s.count++
-			s.deletedCount--
-			s.metric.CountChanged(s.count, s.deletedCount)
+// OpenStore returns a new store that persists all changes in the provided data directory.
+// Data that has been persisted earlier is restored.
+func OpenStore(dataDir string, m Metric) (*Store, error) {
+	j, err := openJournal(dataDir)
+	if err != nil {
+		return nil, errx.Annotatef(err, "open journal")
+	}
+
+	s := NewStore(m)
+	if s.nodeID, err = j.nodeID(); err != nil {
+		j.close()
+		return nil, errx.Annotatef(err, "node id")
+	}
+	if err := j.replay(func(op byte, kh keyHash, data []byte) error {
+		switch op {
+		case journalOpSet:
+			c := &container{}
+			if err := c.UnmarshalBinary(data); err != nil {
+				return errx.Annotatef(err, "unmarshal binary")
+			}
+			s.applyContainer(kh, c)
+		case journalOpRemove:
+			s.removeContainer(kh, data)
+		default:
+			return errx.Errorf("unknown journal operation %d", op)
 		}
-		s.state.Insert(stateItem(kh, c.revision))
-		s.notify(kh, c)
-	} else {
-		c := &container{
-			key:       key,
-			value:     value,
-			revision:  0,
-			deletedAt: time.Time{},
-		}
-		s.containers[kh] = c
-		s.state.Insert(stateItem(kh, 0))
-		s.notify(kh, c)
-		s.count++
-		s.metric.CountChanged(s.count, s.deletedCount)
+		return nil
+	}); err != nil {
+		j.close()
+		return nil, errx.Annotatef(err, "replay journal")
 	}
-	s.containersRWMutex.Unlock()
-	return nil
+	s.journal = j
+	s.metric.CountChanged(s.count, s.deletedCount)
+
+	return s, nil
+}
+
+// Set sets the provided value at the provided key. A previously set expiry is removed.
+func (s *Store) Set(key, value []byte) error {
+	_, err := s.set(key, value, time.Time{}, nil)
+	return err
+}
+
+// SetWithTTL sets the provided value at the provided key. After the provided ttl, the value expires.
+func (s *Store) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	_, err := s.set(key, value, time.Now().Add(ttl), nil)
+	return err
+}
+
+// CompareAndSet sets the provided value at the provided key, if a value exists and it's revision
+// equals the expected one. If the value has been set, true is returned.
+func (s *Store) CompareAndSet(key []byte, expectedRevision uint64, value []byte) (bool, error) {
+	return s.set(key, value, time.Time{}, revisionCondition(expectedRevision))
+}
+
+// SetIfAbsent sets the provided value at the provided key, if no value exists. If the value has
+// been set, true is returned.
+func (s *Store) SetIfAbsent(key, value []byte) (bool, error) {
+	return s.set(key, value, time.Time{}, absentCondition)
+}
+
+// DeleteIfRevision removes the value at the provided key, if it's revision equals the provided
+// one. If the value has been removed, true is returned.
+func (s *Store) DeleteIfRevision(key []byte, revision uint64) (bool, error) {
+	return s.delete(key, revisionCondition(revision))
+}
+
+// writeCondition decides whether a write is applied. It's called with the current container of the
+// key or nil, if no value exists.
+type writeCondition func(*container) bool
+
+func absentCondition(c *container) bool {
+	return c == nil
+}
+
+func presentCondition(c *container) bool {
+	return c != nil
+}
+
+func revisionCondition(revision uint64) writeCondition {
+	return func(c *container) bool {
+		return c != nil && c.revision == revision
+	}
+}
+
+// liveContainer returns the container of the provided key, if it holds a value that is neither
+// deleted nor expired. Otherwise, nil is returned.
+func (s *Store) liveContainer(kh keyHash, key []byte) *container {
+	_, c := s.containers[kh].find(key)
+	if c == nil || c.isDeleted() || c.isExpired(time.Now()) {
+		return nil
+	}
+	return c
+}
+
+// set sets the provided value at the provided key. If a condition is provided and it's not met,
+// nothing is changed and false is returned.
+func (s *Store) set(key, value []byte, expiresAt time.Time, condition writeCondition) (bool, error) {
+	kh := s.keyHashFn(key)
+	s.lock()
+	if condition != nil && !condition(s.liveContainer(kh, key)) {
+		s.unlock()
+		return false, nil
+	}
+	c := s.nextContainer(kh, key, value, expiresAt)
+	if err := s.persist(kh, c); err != nil {
+		s.unlock()
+		return false, errx.Annotatef(err, "persist")
+	}
+	s.applyContainer(kh, c)
+	s.notify(kh, c)
+	s.unlock()
+	return true, nil
+}
+
+// nextContainer returns the next revision of the container of the provided key with the provided
+// value. The store isn't changed. The caller has to hold the write lock.
+func (s *Store) nextContainer(kh keyHash, key, value []byte, expiresAt time.Time) *container {
+	nc := &container{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
+	}
+	if _, c := s.containers[kh].find(key); c != nil {
+		nc.revision = c.revision + 1
+	}
+	s.stamp(nc)
+	return nc
+}
+
+// nextTombstone returns the next revision of the provided container as a tombstone. The store
+// isn't changed. The caller has to hold the write lock.
+func (s *Store) nextTombstone(c *container) *container {
+	nc := &container{
+		key:      c.key,
+		revision: c.revision + 1,
+	}
+	nc.delete()
+	s.stamp(nc)
+	return nc
+}
+
+// GetWithRevision returns the value at the provided key and it's revision. The revision can be
+// passed to CompareAndSet or DeleteIfRevision. If no value exists, nil and a zero revision are
+// returned.
+func (s *Store) GetWithRevision(key []byte) ([]byte, uint64, error) {
+	kh := s.keyHashFn(key)
+	s.containersRWMutex.RLock()
+	defer s.containersRWMutex.RUnlock()
+	c := s.liveContainer(kh, key)
+	if c == nil {
+		return nil, 0, nil
+	}
+	return c.value, c.revision, nil
 }
 
 // Get returns the value at the provided key. If no value exists, nil is returned.
 func (s *Store) Get(key []byte) ([]byte, error) {
-	kh := hashKey(key)
+	kh := s.keyHashFn(key)
 	s.containersRWMutex.RLock()
-	c, ok := s.containers[kh]
-	if ok {
-		if c.isDeleted() {
-			s.containersRWMutex.RUnlock()
-			return nil, nil
-		}
-		value := c.value
+	_, c := s.containers[kh].find(key)
+	if c == nil || c.isDeleted() || c.isExpired(time.Now()) {
 		s.containersRWMutex.RUnlock()
-		return value, nil
+		return nil, nil
 	}
+	value := c.value
 	s.containersRWMutex.RUnlock()
-	return nil, nil
+	return value, nil
+}
+
+// GetWithMeta returns the entry at the provided key including it's meta data. In contrast to
+// Get, deleted values are returned as well. If no entry exists, nil is returned.
+func (s *Store) GetWithMeta(key []byte) (*Entry, error) {
+	kh := s.keyHashFn(key)
+	s.containersRWMutex.RLock()
+	defer s.containersRWMutex.RUnlock()
+	_, c := s.containers[kh].find(key)
+	if c == nil {
+		return nil, nil
+	}
+	entry := newEntry(c)
+	return &entry, nil
+}
+
+// NodeID returns the id of the node this store belongs to.
+func (s *Store) NodeID() string {
+	return s.nodeID.String()
 }
 
 // Delete removes the value at the provided key.
 func (s *Store) Delete(key []byte) error {
-	hk := hashKey(key)
-	s.containersRWMutex.Lock()
-	if c, ok := s.containers[hk]; ok {
-		if !c.isDeleted() {
-			s.state.Remove(stateItem(hk, c.revision))
-			c.value = nil
-			c.delete()
-			c.revision++
-			s.state.Insert(stateItem(hk, c.revision))
-			s.notify(hk, c)
-			s.count--
-			s.deletedCount++
-			s.metric.CountChanged(s.count, s.deletedCount)
-		}
+	_, err := s.delete(key, nil)
+	return err
+}
+
+// delete removes the value at the provided key. If no value exists or the provided condition is
+// not met, false is returned.
+func (s *Store) delete(key []byte, condition writeCondition) (bool, error) {
+	kh := s.keyHashFn(key)
+	s.lock()
+	defer s.unlock()
+	_, c := s.containers[kh].find(key)
+	if c == nil || c.isDeleted() {
+		return false, nil
 	}
-	s.containersRWMutex.Unlock()
-	return nil
+	if condition != nil && !condition(s.liveContainer(kh, key)) {
+		return false, nil
+	}
+	existed := !c.isExpired(time.Now())
+	if err := s.deleteContainer(kh, c); err != nil {
+		return false, err
+	}
+	return existed, nil
+}
+
+// Expire sets a ttl on the value at the provided key. If no value exists, false is returned.
+func (s *Store) Expire(key []byte, ttl time.Duration) (bool, error) {
+	return s.setExpiresAt(key, time.Now().Add(ttl))
+}
+
+// Persist removes the expiry from the value at the provided key. If no value exists or the
+// value has no expiry, false is returned.
+func (s *Store) Persist(key []byte) (bool, error) {
+	return s.setExpiresAt(key, time.Time{})
+}
+
+// TTL returns the remaining time-to-live of the value at the provided key. If no value exists,
+// TTLNotExisting is returned. If the value doesn't expire, TTLNotSet is returned.
+func (s *Store) TTL(key []byte) (time.Duration, error) {
+	kh := s.keyHashFn(key)
+	now := time.Now()
+	s.containersRWMutex.RLock()
+	defer s.containersRWMutex.RUnlock()
+	_, c := s.containers[kh].find(key)
+	if c == nil || c.isDeleted() || c.isExpired(now) {
+		return TTLNotExisting, nil
+	}
+	if c.expiresAt.IsZero() {
+		return TTLNotSet, nil
+	}
+	return c.expiresAt.Sub(now), nil
+}
+
+func (s *Store) setExpiresAt(key []byte, expiresAt time.Time) (bool, error) {
+	kh := s.keyHashFn(key)
+	s.lock()
+	defer s.unlock()
+	_, c := s.containers[kh].find(key)
+	if c == nil || c.isDeleted() || c.isExpired(time.Now()) {
+		return false, nil
+	}
+	if expiresAt.IsZero() && c.expiresAt.IsZero() {
+		return false, nil
+	}
+	nc := *c
+	nc.expiresAt = expiresAt
+	nc.revision++
+	s.stamp(&nc)
+	if err := s.persist(kh, &nc); err != nil {
+		return false, errx.Annotatef(err, "persist")
+	}
+	s.applyContainer(kh, &nc)
+	s.notify(kh, &nc)
+	return true, nil
 }
 
 // Each interates over all key-value-pairs.
 func (s *Store) Each(fn func([]byte, []byte) error) (err error) {
+	now := time.Now()
 	s.containersRWMutex.RLock()
-	for _, c := range s.containers {
-		if c.isDeleted() {
-			continue
-		}
-		if err = fn(c.key, c.value); err != nil {
-			break
+	defer s.containersRWMutex.RUnlock()
+	for _, b := range s.containers {
+		for _, c := range b {
+			if c.isDeleted() || c.isExpired(now) {
+				continue
+			}
+			if err = fn(c.key, c.value); err != nil {
+				return
+			}
 		}
 	}
-	s.containersRWMutex.RUnlock()
 	return
 }
 
+// Scan iterates over all key-value-pairs with start <= key < end in ascending order of the keys.
+// A nil start or end means no limit.
+func (s *Store) Scan(start, end []byte, fn func([]byte, []byte) error) error {
+	return s.scanRange(start, end, false, fn)
+}
+
+// ScanReverse iterates over all key-value-pairs with start <= key < end in descending order of
+// the keys. A nil start or end means no limit.
+func (s *Store) ScanReverse(start, end []byte, fn func([]byte, []byte) error) error {
+	return s.scanRange(start, end, true, fn)
+}
+
+// ScanPrefix iterates over all key-value-pairs, whose key has the provided prefix, in ascending
+// order of the keys.
+func (s *Store) ScanPrefix(prefix []byte, fn func([]byte, []byte) error) error {
+	return s.scanRange(prefix, prefixEnd(prefix), false, fn)
+}
+
+// ScanPrefixReverse iterates over all key-value-pairs, whose key has the provided prefix, in
+// descending order of the keys.
+func (s *Store) ScanPrefixReverse(prefix []byte, fn func([]byte, []byte) error) error {
+	return s.scanRange(prefix, prefixEnd(prefix), true, fn)
+}
+
+func (s *Store) scanRange(start, end []byte, reverse bool, fn func([]byte, []byte) error) (err error) {
+	now := time.Now()
+	s.containersRWMutex.RLock()
+	defer s.containersRWMutex.RUnlock()
+	iterate := s.index.ascend
+	if reverse {
+		iterate = s.index.descend
+	}
+	iterate(start, end, func(key []byte) bool {
+		_, c := s.containers[s.keyHashFn(key)].find(key)
+		if c == nil || c.isDeleted() || c.isExpired(now) {
+			return true
+		}
+		err = fn(c.key, c.value)
+		return err == nil
+	})
+	return
+}
+
+// scan returns the keys of up to count buckets, whose key hash is equal or greater than the
+// cursor, in the order of their key hashes. The returned cursor points to the next bucket or is
+// zero, if all buckets have been scanned. Since the cursor is derived from the key hashes, keys
+// that exist during the whole scan are returned regardless of concurrent changes.
+func (s *Store) scan(cursor uint64, count int) ([][]byte, uint64) {
+	now := time.Now()
+	start := make([]byte, keyHashSize)
+	binary.BigEndian.PutUint64(start, cursor)
+	keys := [][]byte{}
+	next := uint64(0)
+	s.containersRWMutex.RLock()
+	s.bucketIndex.ascend(start, nil, func(data []byte) bool {
+		if count == 0 {
+			next = binary.BigEndian.Uint64(data)
+			return false
+		}
+		count--
+		for _, c := range s.containers[newKeyHash(data)] {
+			if !c.isDeleted() && !c.isExpired(now) {
+				keys = append(keys, c.key)
+			}
+		}
+		return true
+	})
+	s.containersRWMutex.RUnlock()
+	return keys, next
+}
+
 // Len returns the length of the store.
 func (s *Store) Len() int {
+	s.containersRWMutex.RLock()
+	defer s.containersRWMutex.RUnlock()
 	return s.count
 }
 
+// liveLen returns the number of values, that are neither deleted nor expired. Unlike Len, it
+// doesn't count expired values, that haven't been swept yet.
+func (s *Store) liveLen() int {
+	s.containersRWMutex.RLock()
+	defer s.containersRWMutex.RUnlock()
+	count := 0
+	for kh, b := range s.containers {
+		for _, c := range b {
+			if s.liveContainer(kh, c.key) != nil {
+				count++
+			}
+		}
+	}
+	return count
+}
+
 // DeletedLen returns the length of deleted values.
 func (s *Store) DeletedLen() int {
+	s.containersRWMutex.RLock()
+	defer s.containersRWMutex.RUnlock()
 	return s.deletedCount
 }
 
-// Tidy removes all deleted values from the store.
+// Sweep turns all expired values into deleted values.
+func (s *Store) Sweep() error {
+	now := time.Now()
+	s.lock()
+	defer s.unlock()
+	for kh, b := range s.containers {
+		for _, c := range b {
+			if c.isDeleted() || !c.isExpired(now) {
+				continue
+			}
+			if err := s.deleteContainer(kh, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetTombstoneGracePeriod sets the duration for which deleted values are kept, before they can
+// be removed by Tidy.
+func (s *Store) SetTombstoneGracePeriod(gracePeriod time.Duration) {
+	s.lock()
+	s.gracePeriod = gracePeriod
+	s.unlock()
+}
+
+// SetSync sets whether the write-ahead log is synced to disk after each write. Sync is enabled by
+// default. If the store is not persistent, nothing is done.
+func (s *Store) SetSync(enabled bool) {
+	s.lock()
+	if s.journal != nil {
+		s.journal.sync = enabled
+	}
+	s.unlock()
+}
+
+// Tidy removes all deleted values from the store, that are older than the tombstone grace period
+// and have been acknowledged by all peers. Deleted values that are still unknown to a peer are
+// kept, so a later reconciliation with that peer can't bring them back.
 func (s *Store) Tidy() error {
-	s.containersRWMutex.Lock()
-	changed := false
-	for hk, c := range s.containers {
-		if c.isDeleted() {
-			delete(s.containers, hk)
-			s.deletedCount--
-			changed = true
+	now := time.Now()
+	s.lock()
+	defer s.unlock()
+	purged := []tombstone{}
+	graceCount, unacknowledgedCount := 0, 0
+	for _, b := range s.containers {
+		for _, c := range b {
+			if !c.isDeleted() {
+				continue
+			}
+			if now.Sub(c.deletedAt) < s.gracePeriod {
+				graceCount++
+				continue
+			}
+			if s.acknowledgedFn != nil && !s.acknowledgedFn(c.key, c.revision) {
+				unacknowledgedCount++
+				continue
+			}
+			purged = append(purged, tombstone{key: c.key, revision: c.revision})
 		}
 	}
-	if changed {
+	for _, t := range purged {
+		kh := s.keyHashFn(t.key)
+		if err := s.persistRemove(kh, t.key); err != nil {
+			return errx.Annotatef(err, "persist")
+		}
+		s.removeContainer(kh, t.key)
+		if s.purgedFn != nil {
+			s.purgedFn(t.key)
+		}
+	}
+	s.metric.Tidied(len(purged), graceCount, unacknowledgedCount)
+	if len(purged) > 0 {
 		s.metric.CountChanged(s.count, s.deletedCount)
 	}
-	s.containersRWMutex.Unlock()
+	return nil
+}
+
+// Snapshot writes all values into a compacted snapshot and truncates the write-ahead log.
+// If the store is not persistent, nothing is done.
+func (s *Store) Snapshot() error {
+	if s.journal == nil {
+		return nil
+	}
+	s.lock()
+	err := s.journal.snapshot(func(write func(keyHash, []byte) error) error {
+		for kh, b := range s.containers {
+			for _, c := range b {
+				bytes, err := c.MarshalBinary()
+				if err != nil {
+					return errx.Annotatef(err, "marshal binary")
+				}
+				if err := write(kh, bytes); err != nil {
+					return errx.Annotatef(err, "write [%s]", kh)
+				}
+			}
+		}
+		return nil
+	})
+	s.unlock()
+	if err != nil {
+		return errx.Annotatef(err, "snapshot")
+	}
+	return nil
+}
+
+// Close writes a final snapshot and closes the underlying files of a persistent store.
+func (s *Store) Close() error {
+	if s.journal == nil {
+		return nil
+	}
+	if err := s.Snapshot(); err != nil {
+		return errx.Annotatef(err, "snapshot")
+	}
+	if err := s.journal.close(); err != nil {
+		return errx.Annotatef(err, "close journal")
+	}
 	return nil
 }
 
@@ -166,16 +602,185 @@ func (s *Store) State() *Set {
 	return s.state
 }
 
+// stateSnapshot returns a copy of the state set. Other than the state set itself, the copy can
+// be used without holding the store lock.
+func (s *Store) stateSnapshot() *Set {
+	s.containersRWMutex.RLock()
+	items := s.state.Items()
+	s.containersRWMutex.RUnlock()
+
+	state := NewSet()
+	for _, item := range items {
+		state.Insert(item)
+	}
+	return state
+}
+
 func (s *Store) setContainer(kh keyHash, bytes []byte) error {
-	nc := &container{}
-	if err := nc.UnmarshalBinary(bytes); err != nil {
-		return errx.Annotatef(err, "unmarshal binary")
+	_, err := s.setContainers([]containerUpdate{{keyHash: kh, bytes: bytes}})
+	return err
+}
+
+// setContainers applies all provided containers within a single acquisition of the store lock.
+// Copies of the containers that have been applied, are returned. Containers that are equal to or
+// older than the local ones, are ignored, so an update that has already been seen, is never
+// returned twice.
+func (s *Store) setContainers(updates []containerUpdate) ([]container, error) {
+	containers := make([]*container, len(updates))
+	for index, u := range updates {
+		nc := &container{}
+		if err := nc.UnmarshalBinary(u.bytes); err != nil {
+			return nil, errx.Annotatef(err, "unmarshal binary")
+		}
+		if s.keyHashFn(nc.key) != u.keyHash {
+			return nil, errx.BadRequestf("key hash of [%s] doesn't match [%s]", nc.key, u.keyHash)
+		}
+		nc.hops = u.hops
+		s.clock.update(nc.timestamp)
+		containers[index] = nc
 	}
 
-	s.containersRWMutex.Lock()
-	if c, ok := s.containers[kh]; ok {
-		s.state.Remove(stateItem(kh, c.revision))
-		s.containers[kh] = nc
+	applied := []container{}
+	s.lock()
+	defer s.unlock()
+	for index, nc := range containers {
+		ok, err := s.applyRemoteContainer(updates[index].keyHash, nc)
+		if err != nil {
+			return nil, errx.Annotatef(err, "apply [%s]", nc.key)
+		}
+		if ok {
+			applied = append(applied, *nc)
+		}
+	}
+	changes := make([]change, len(applied))
+	for index := range applied {
+		changes[index] = change{keyHash: s.keyHashFn(applied[index].key), container: &applied[index]}
+	}
+	s.watchers.dispatch(changes, true)
+	return applied, nil
+}
+
+// applyRemoteContainer applies the provided container, if it's newer than the local one. If the
+// container has been applied, true is returned.
+func (s *Store) applyRemoteContainer(kh keyHash, nc *container) (bool, error) {
+	_, c := s.containers[kh].find(nc.key)
+	if c != nil && !c.isDeleted() && !nc.isDeleted() && (c.newerThan(nc) || nc.newerThan(c)) {
+		if r := s.resolverFor(nc.key); r != nil {
+			return s.resolveContainer(kh, r, c, nc)
+		}
+	}
+	if c != nil && !nc.newerThan(c) {
+		return false, nil
+	}
+	if err := s.persist(kh, nc); err != nil {
+		return false, errx.Annotatef(err, "persist")
+	}
+	s.applyContainer(kh, nc)
+	return true, nil
+}
+
+// resolveContainer merges the local and the remote container using the provided resolver. If
+// the merge result equals the newer container, that one is kept. Otherwise, the result is stored
+// with a new revision and propagated to the peers. If the remote container has been applied
+// unchanged, true is returned. The caller has to hold the write lock, which is held while the
+// resolver runs.
+func (s *Store) resolveContainer(kh keyHash, r Resolver, c, nc *container) (bool, error) {
+	merged, err := r.Resolve(newEntry(c), newEntry(nc))
+	if err != nil {
+		return false, errx.Annotatef(err, "resolve [%s]", nc.key)
+	}
+
+	switch {
+	case bytes.Equal(merged, nc.value) && nc.newerThan(c):
+		if err := s.persist(kh, nc); err != nil {
+			return false, errx.Annotatef(err, "persist")
+		}
+		s.applyContainer(kh, nc)
+		return true, nil
+	case bytes.Equal(merged, c.value) && c.newerThan(nc):
+		s.replicate([]change{{keyHash: kh, container: c}})
+	default:
+		mc := &container{
+			key:       c.key,
+			value:     merged,
+			revision:  c.revision + 1,
+			expiresAt: c.expiresAt,
+		}
+		if nc.revision >= c.revision {
+			mc.revision = nc.revision + 1
+		}
+		if nc.newerThan(c) {
+			mc.expiresAt = nc.expiresAt
+		}
+		s.stamp(mc)
+		if err := s.persist(kh, mc); err != nil {
+			return false, errx.Annotatef(err, "persist")
+		}
+		s.applyContainer(kh, mc)
+		s.notify(kh, mc)
+	}
+	return false, nil
+}
+
+// modifyBucket calls the provided function with the bucket at the provided key hash and
+// updates the state set and the bucket index according to the returned bucket.
+func (s *Store) modifyBucket(kh keyHash, fn func(bucket) bucket) {
+	b := s.containers[kh]
+	existed := len(b) > 0
+	if existed {
+		s.state.Remove(stateItem(kh, b.revision()))
+	}
+	b = fn(b)
+	switch {
+	case len(b) > 0:
+		s.containers[kh] = b
+		s.state.Insert(stateItem(kh, b.revision()))
+		if !existed {
+			s.bucketIndex.insert(kh[:])
+		}
+	case existed:
+		delete(s.containers, kh)
+		s.bucketIndex.remove(kh[:])
+	}
+}
+
+// stamp marks the container as written by this node.
+func (s *Store) stamp(c *container) {
+	c.timestamp = s.clock.now()
+	c.origin = s.nodeID
+	c.hops = 0
+}
+
+// deleteContainer replaces the provided container with a tombstone. The tombstone is persisted
+// before it's applied, so a failed write doesn't change the store. The caller has to hold the
+// write lock.
+func (s *Store) deleteContainer(kh keyHash, c *container) error {
+	tc := s.nextTombstone(c)
+	if err := s.persist(kh, tc); err != nil {
+		return errx.Annotatef(err, "persist")
+	}
+	s.applyContainer(kh, tc)
+	s.notify(kh, tc)
+	return nil
+}
+
+// applyContainer installs the provided container. The caller has to hold the write lock.
+func (s *Store) applyContainer(kh keyHash, nc *container) {
+	if nc.isDeleted() {
+		atomic.AddUint64(&s.tombstoneCount, 1)
+	}
+	s.modifyBucket(kh, func(b bucket) bucket {
+		index, c := b.find(nc.key)
+		if c == nil {
+			if nc.isDeleted() {
+				s.deletedCount++
+			} else {
+				s.count++
+			}
+			s.metric.CountChanged(s.count, s.deletedCount)
+			s.index.insert(nc.key)
+			return append(b, nc)
+		}
 		switch {
 		case !c.isDeleted() && nc.isDeleted():
 			s.count--
@@ -186,43 +791,169 @@ func (s *Store) setContainer(kh keyHash, bytes []byte) error {
 			s.deletedCount--
 			s.metric.CountChanged(s.count, s.deletedCount)
 		}
-		s.state.Insert(stateItem(kh, nc.revision))
-	} else {
-		s.containers[kh] = nc
-		s.state.Insert(stateItem(kh, 0))
-		if nc.isDeleted() {
-			s.deletedCount++
+		b[index] = nc
+		return b
+	})
+}
+
+func (s *Store) removeContainer(kh keyHash, key []byte) {
+	s.modifyBucket(kh, func(b bucket) bucket {
+		index, c := b.find(key)
+		if c == nil {
+			return b
+		}
+		if c.isDeleted() {
+			s.deletedCount--
 		} else {
-			s.count++
+			s.count--
+		}
+		s.index.remove(key)
+		return b.remove(index)
+	})
+}
+
+func (s *Store) tombstones() []tombstone {
+	s.containersRWMutex.RLock()
+	result := []tombstone{}
+	for _, b := range s.containers {
+		for _, c := range b {
+			if c.isDeleted() {
+				result = append(result, tombstone{key: c.key, revision: c.revision})
+			}
 		}
-		s.metric.CountChanged(s.count, s.deletedCount)
 	}
-	s.containersRWMutex.Unlock()
+	s.containersRWMutex.RUnlock()
+	return result
+}
 
-	return nil
+// tombstoneGeneration returns the number of tombstones, that have been applied so far. It can be
+// used to detect new tombstones without scanning the store.
+func (s *Store) tombstoneGeneration() uint64 {
+	return atomic.LoadUint64(&s.tombstoneCount)
+}
+
+func (s *Store) getRevision(key []byte) (uint64, bool) {
+	kh := s.keyHashFn(key)
+	s.containersRWMutex.RLock()
+	_, c := s.containers[kh].find(key)
+	if c == nil {
+		s.containersRWMutex.RUnlock()
+		return 0, false
+	}
+	revision := c.revision
+	s.containersRWMutex.RUnlock()
+	return revision, true
 }
 
-func (s *Store) getContainer(kh keyHash) ([]byte, error) {
+// getContainer returns the container of the provided key encoded in the provided format version.
+// If no container exists, nil is returned.
+func (s *Store) getContainer(key []byte, version byte) ([]byte, error) {
+	kh := s.keyHashFn(key)
 	s.containersRWMutex.RLock()
-	c, ok := s.containers[kh]
-	if ok {
-		bytes, err := c.MarshalBinary()
+	defer s.containersRWMutex.RUnlock()
+	_, c := s.containers[kh].find(key)
+	if c == nil {
+		return nil, nil
+	}
+	bytes, err := c.marshalBinaryVersion(version)
+	if err != nil {
+		return nil, errx.Annotatef(err, "marshal binary")
+	}
+	return bytes, nil
+}
+
+// getContainers returns all containers in the bucket at the provided key hash encoded in the
+// provided format version.
+func (s *Store) getContainers(kh keyHash, version byte) ([][]byte, error) {
+	s.containersRWMutex.RLock()
+	defer s.containersRWMutex.RUnlock()
+	b := s.containers[kh]
+	result := make([][]byte, len(b))
+	for index, c := range b {
+		bytes, err := c.marshalBinaryVersion(version)
 		if err != nil {
-			s.containersRWMutex.RUnlock()
 			return nil, errx.Annotatef(err, "marshal binary")
 		}
-		s.containersRWMutex.RUnlock()
-		return bytes, nil
+		result[index] = bytes
 	}
-	s.containersRWMutex.RUnlock()
-	return nil, nil
+	return result, nil
+}
+
+func (s *Store) persist(kh keyHash, c *container) error {
+	if s.journal == nil {
+		return nil
+	}
+	bytes, err := c.MarshalBinary()
+	if err != nil {
+		return errx.Annotatef(err, "marshal binary")
+	}
+	return s.journal.append(journalOpSet, kh, bytes)
+}
+
+// persistChanges writes the provided changes into a single journal record, so they're restored
+// all or not at all.
+func (s *Store) persistChanges(changes []change) error {
+	if s.journal == nil {
+		return nil
+	}
+	records := make([][]byte, len(changes))
+	for index, ch := range changes {
+		bytes, err := ch.container.MarshalBinary()
+		if err != nil {
+			return errx.Annotatef(err, "marshal binary")
+		}
+		records[index] = journalRecord(journalOpSet, ch.keyHash, bytes)
+	}
+	return s.journal.appendBatch(records)
+}
+
+func (s *Store) persistRemove(kh keyHash, key []byte) error {
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.append(journalOpRemove, kh, key)
 }
 
 func (s *Store) notify(kh keyHash, c *container) {
+	s.notifyChanges([]change{{keyHash: kh, container: c}})
+}
+
+// notifyChanges reports the provided changes as a unit to the watchers and the peers.
+func (s *Store) notifyChanges(changes []change) {
+	s.watchers.dispatch(changes, false)
+	s.replicate(changes)
+}
+
+// replicate collects the provided changes as a unit for the update function, so they're replicated
+// together. Copies are collected, so the receivers can't modify the store's containers. The caller
+// has to hold the write lock.
+func (s *Store) replicate(changes []change) {
 	if s.updateFn == nil {
 		return
 	}
-	s.updateFn(kh, c)
+	copies := make([]change, len(changes))
+	for index, ch := range changes {
+		c := *ch.container
+		copies[index] = change{keyHash: ch.keyHash, container: &c}
+	}
+	s.pendingUpdates = append(s.pendingUpdates, copies)
+}
+
+// lock acquires the write lock of the store.
+func (s *Store) lock() {
+	s.containersRWMutex.Lock()
+}
+
+// unlock releases the write lock and passes the changes, that have been collected meanwhile, to
+// the update function. The update function may block on a full peer queue, so it's never called
+// while the lock is held.
+func (s *Store) unlock() {
+	pending := s.pendingUpdates
+	s.pendingUpdates = nil
+	s.containersRWMutex.Unlock()
+	for _, changes := range pending {
+		s.updateFn(changes)
+	}
 }
 
 func hashKey(k []byte) keyHash {
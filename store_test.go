@@ -1,10 +1,13 @@
 package deks_test
 
 import (
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/simia-tech/errx"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -60,6 +63,26 @@ func TestStoreGet(t *testing.T) {
 	assert.Equal(t, testValue, value)
 }
 
+func TestStoreGetWithMeta(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	entry, err := e.storeOne.GetWithMeta(testKey)
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeOne.Delete(testKey))
+
+	entry, err = e.storeOne.GetWithMeta(testKey)
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	assert.Equal(t, uint64(1), entry.Revision)
+	assert.True(t, entry.Deleted)
+	assert.Equal(t, e.storeOne.NodeID(), entry.Origin)
+	assert.WithinDuration(t, time.Now(), entry.Timestamp, time.Second)
+}
+
 func TestStoreDelete(t *testing.T) {
 	e := setUpTestEnvironment(t)
 	defer e.tearDown()
@@ -73,6 +96,68 @@ func TestStoreDelete(t *testing.T) {
 	assert.Equal(t, []deks.Item{{0xa6, 0x2f, 0x22, 0x25, 0xbf, 0x70, 0xbf, 0xac, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1}}, e.storeOne.State().Items())
 }
 
+func TestStoreSetWithTTL(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeOne.SetWithTTL(testKey, testValue, 50*time.Millisecond))
+
+	value, err := e.storeOne.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+
+	time.Sleep(60 * time.Millisecond)
+
+	value, err = e.storeOne.Get(testKey)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestStoreExpireAndPersist(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	ttl, err := e.storeOne.TTL(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, deks.TTLNotExisting, ttl)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+
+	ttl, err = e.storeOne.TTL(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, deks.TTLNotSet, ttl)
+
+	ok, err := e.storeOne.Expire(testKey, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ttl, err = e.storeOne.TTL(testKey)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute, ttl, float64(time.Second))
+
+	ok, err = e.storeOne.Persist(testKey)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ttl, err = e.storeOne.TTL(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, deks.TTLNotSet, ttl)
+}
+
+func TestStoreSweep(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeOne.SetWithTTL(testKey, testValue, time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+
+	require.NoError(t, e.storeOne.Sweep())
+
+	assert.Equal(t, 0, e.storeOne.Len())
+	assert.Equal(t, 1, e.storeOne.DeletedLen())
+	assert.Equal(t, []deks.Item{{0xa6, 0x2f, 0x22, 0x25, 0xbf, 0x70, 0xbf, 0xac, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1}}, e.storeOne.State().Items())
+}
+
 func TestStoreEach(t *testing.T) {
 	e := setUpTestEnvironment(t)
 	defer e.tearDown()
@@ -104,6 +189,52 @@ func TestStoreTidy(t *testing.T) {
 	assert.Equal(t, 0, e.storeOne.Len())
 }
 
+func TestStoreTidyWithinGracePeriod(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	e.storeOne.SetTombstoneGracePeriod(time.Hour)
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeOne.Delete(testKey))
+
+	require.NoError(t, e.storeOne.Tidy())
+
+	assert.Equal(t, 1, e.storeOne.DeletedLen())
+}
+
+func TestStoreKeyHashCollision(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	deks.SetKeyHashFunc(e.storeOne, collidingKeyHash)
+
+	require.NoError(t, e.storeOne.Set(testKey, testValue))
+	require.NoError(t, e.storeOne.Set(testAnotherKey, testAnotherValue))
+
+	assert.Equal(t, 2, e.storeOne.Len())
+	assert.Equal(t, 1, e.storeOne.State().Len())
+
+	value, err := e.storeOne.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+
+	value, err = e.storeOne.Get(testAnotherKey)
+	require.NoError(t, err)
+	assert.Equal(t, testAnotherValue, value)
+
+	require.NoError(t, e.storeOne.Delete(testKey))
+
+	value, err = e.storeOne.Get(testAnotherKey)
+	require.NoError(t, err)
+	assert.Equal(t, testAnotherValue, value)
+
+	require.NoError(t, e.storeOne.Tidy())
+
+	assert.Equal(t, 1, e.storeOne.Len())
+	assert.Equal(t, 0, e.storeOne.DeletedLen())
+	assert.Equal(t, 1, e.storeOne.State().Len())
+}
+
 func TestStoreConcurrentAccess(t *testing.T) {
 	e := setUpTestEnvironment(t)
 	defer e.tearDown()
@@ -149,3 +280,356 @@ func BenchmarkStoreGet(b *testing.B) {
 		e.storeOne.Get(testKey)
 	}
 }
+
+func TestStorePersistence(t *testing.T) {
+	dataDir := t.TempDir()
+	m := deks.NewMetricMock()
+
+	store, err := deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	require.NoError(t, store.Set(testKey, testValue))
+	require.NoError(t, store.Set(testAnotherKey, testValue))
+	require.NoError(t, store.Delete(testAnotherKey))
+	require.NoError(t, store.Close())
+
+	store, err = deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	defer store.Close()
+
+	assert.Equal(t, 1, store.Len())
+	assert.Equal(t, 1, store.DeletedLen())
+	assert.Equal(t, 2, store.State().Len())
+	value, err := store.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+}
+
+func TestStorePersistsNodeID(t *testing.T) {
+	dataDir := t.TempDir()
+	m := deks.NewMetricMock()
+
+	store, err := deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	nodeID := store.NodeID()
+	require.NoError(t, store.Close())
+
+	store, err = deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	defer store.Close()
+
+	assert.Equal(t, nodeID, store.NodeID())
+	assert.NotEqual(t, nodeID, deks.NewStore(m).NodeID())
+}
+
+func TestStorePersistenceWithoutSnapshot(t *testing.T) {
+	dataDir := t.TempDir()
+	m := deks.NewMetricMock()
+
+	store, err := deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	require.NoError(t, store.Set(testKey, testValue))
+	require.NoError(t, store.Set(testKey, testAnotherValue))
+
+	restoredStore, err := deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	defer restoredStore.Close()
+
+	assert.Equal(t, 1, restoredStore.Len())
+	assert.Equal(t, []deks.Item{{0xa6, 0x2f, 0x22, 0x25, 0xbf, 0x70, 0xbf, 0xac, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1}}, restoredStore.State().Items())
+	value, err := restoredStore.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testAnotherValue, value)
+}
+
+func TestStorePersistenceWithCorruptedLog(t *testing.T) {
+	dataDir := t.TempDir()
+	m := deks.NewMetricMock()
+
+	store, err := deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	require.NoError(t, store.Set(testKey, testValue))
+	require.NoError(t, store.Set(testAnotherKey, testValue))
+
+	logPath := filepath.Join(dataDir, "wal")
+	info, err := os.Stat(logPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(logPath, info.Size()-1))
+
+	restoredStore, err := deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	defer restoredStore.Close()
+
+	assert.Equal(t, 1, restoredStore.Len())
+	value, err := restoredStore.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+}
+
+func TestStorePersistenceOfTidy(t *testing.T) {
+	dataDir := t.TempDir()
+	m := deks.NewMetricMock()
+
+	store, err := deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	require.NoError(t, store.Set(testKey, testValue))
+	require.NoError(t, store.Delete(testKey))
+	require.NoError(t, store.Tidy())
+
+	restoredStore, err := deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	defer restoredStore.Close()
+
+	assert.Equal(t, 0, restoredStore.Len())
+	assert.Equal(t, 0, restoredStore.DeletedLen())
+	assert.Equal(t, 0, restoredStore.State().Len())
+}
+
+func TestStoreFailedPersistence(t *testing.T) {
+	store, err := deks.OpenStore(t.TempDir(), deks.NewMetricMock())
+	require.NoError(t, err)
+	require.NoError(t, store.Set(testKey, testValue))
+	require.NoError(t, deks.BreakJournal(store))
+
+	assert.Error(t, store.Set(testKey, testAnotherValue))
+	assert.Error(t, store.Set(testAnotherKey, testValue))
+	assert.Error(t, store.Delete(testKey))
+	_, err = store.Expire(testKey, time.Hour)
+	assert.Error(t, err)
+
+	value, revision, err := store.GetWithRevision(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+	assert.Equal(t, uint64(0), revision)
+	ttl, err := store.TTL(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, deks.TTLNotSet, ttl)
+	assert.Equal(t, 1, store.Len())
+	assert.Equal(t, 0, store.DeletedLen())
+	assert.Equal(t, 1, store.State().Len())
+}
+
+func TestStorePersistenceAfterTornWrite(t *testing.T) {
+	dataDir := t.TempDir()
+	store, err := deks.OpenStore(dataDir, deks.NewMetricMock())
+	require.NoError(t, err)
+	require.NoError(t, store.Set(testKey, testValue))
+	require.NoError(t, deks.TearJournal(store))
+	require.NoError(t, store.Set(testAnotherKey, testAnotherValue))
+
+	// the store isn't closed, so the write-ahead log is replayed like after a crash.
+	store, err = deks.OpenStore(dataDir, deks.NewMetricMock())
+	require.NoError(t, err)
+
+	value, err := store.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+	value, err = store.Get(testAnotherKey)
+	require.NoError(t, err)
+	assert.Equal(t, testAnotherValue, value)
+}
+
+func TestStoreScan(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	for _, key := range []string{"user:1:name", "user:42:mail", "user:42:name", "user:5:name", "users"} {
+		require.NoError(t, e.storeOne.Set([]byte(key), testValue))
+	}
+	require.NoError(t, e.storeOne.Delete([]byte("user:42:mail")))
+
+	collect := func(scan func(func([]byte, []byte) error) error) []string {
+		keys := []string{}
+		require.NoError(t, scan(func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		}))
+		return keys
+	}
+
+	assert.Equal(t, []string{"user:1:name", "user:42:name"}, collect(func(fn func([]byte, []byte) error) error {
+		return e.storeOne.Scan([]byte("user:1"), []byte("user:5"), fn)
+	}))
+	assert.Equal(t, []string{"users", "user:5:name", "user:42:name"}, collect(func(fn func([]byte, []byte) error) error {
+		return e.storeOne.ScanReverse([]byte("user:4"), nil, fn)
+	}))
+	assert.Equal(t, []string{"user:42:name"}, collect(func(fn func([]byte, []byte) error) error {
+		return e.storeOne.ScanPrefix([]byte("user:42:"), fn)
+	}))
+	assert.Equal(t, []string{"user:5:name", "user:42:name", "user:1:name"}, collect(func(fn func([]byte, []byte) error) error {
+		return e.storeOne.ScanPrefixReverse([]byte("user:"), fn)
+	}))
+}
+
+func TestStoreConditionalWrites(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	ok, err := e.storeOne.CompareAndSet(testKey, 0, testValue)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = e.storeOne.SetIfAbsent(testKey, testValue)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = e.storeOne.SetIfAbsent(testKey, []byte("other"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	value, revision, err := e.storeOne.GetWithRevision(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+
+	ok, err = e.storeOne.CompareAndSet(testKey, revision+1, []byte("other"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = e.storeOne.CompareAndSet(testKey, revision, []byte("other"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = e.storeOne.DeleteIfRevision(testKey, revision)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = e.storeOne.DeleteIfRevision(testKey, revision+1)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	value, _, err = e.storeOne.GetWithRevision(testKey)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+
+	ok, err = e.storeOne.SetIfAbsent(testKey, testValue)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestStoreCompareAndSetConcurrently(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeOne.Set(testKey, []byte{0}))
+
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for increments := 0; increments < 50; {
+				value, revision, err := e.storeOne.GetWithRevision(testKey)
+				require.NoError(t, err)
+				ok, err := e.storeOne.CompareAndSet(testKey, revision, []byte{value[0] + 1})
+				require.NoError(t, err)
+				if ok {
+					increments++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := e.storeOne.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{200}, value)
+}
+
+func TestStoreUpdate(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	require.NoError(t, e.storeOne.Set(testAnotherKey, testValue))
+
+	require.NoError(t, e.storeOne.Update(func(tx *deks.Tx) error {
+		require.NoError(t, tx.Set(testKey, testValue))
+		require.NoError(t, tx.Delete(testAnotherKey))
+
+		value, err := tx.Get(testKey)
+		require.NoError(t, err)
+		assert.Equal(t, testValue, value)
+		value, err = tx.Get(testAnotherKey)
+		require.NoError(t, err)
+		assert.Nil(t, value)
+		return nil
+	}))
+
+	value, err := e.storeOne.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+	value, err = e.storeOne.Get(testAnotherKey)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+
+	err = e.storeOne.Update(func(tx *deks.Tx) error {
+		require.NoError(t, tx.Set(testAnotherKey, testValue))
+		return errx.Errorf("abort")
+	})
+	require.EqualError(t, err, "abort")
+
+	value, err = e.storeOne.Get(testAnotherKey)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestStorePersistenceOfUpdate(t *testing.T) {
+	dataDir := t.TempDir()
+	m := deks.NewMetricMock()
+
+	store, err := deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	require.NoError(t, store.Update(func(tx *deks.Tx) error {
+		require.NoError(t, tx.Set(testKey, testValue))
+		return tx.Set(testAnotherKey, testValue)
+	}))
+	require.NoError(t, store.Close())
+
+	store, err = deks.OpenStore(dataDir, m)
+	require.NoError(t, err)
+	defer store.Close()
+
+	assert.Equal(t, 2, store.Len())
+	value, err := store.Get(testAnotherKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+}
+
+func TestStoreFailedUpdate(t *testing.T) {
+	store, err := deks.OpenStore(t.TempDir(), deks.NewMetricMock())
+	require.NoError(t, err)
+	require.NoError(t, store.Set(testKey, testValue))
+	require.NoError(t, deks.BreakJournal(store))
+
+	events, cancel := store.Watch(nil)
+	defer cancel()
+
+	assert.Error(t, store.Update(func(tx *deks.Tx) error {
+		require.NoError(t, tx.Delete(testKey))
+		return tx.Set(testAnotherKey, testValue)
+	}))
+
+	value, err := store.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+	value, err = store.Get(testAnotherKey)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+	assert.Equal(t, 1, store.Len())
+	assert.Equal(t, 0, store.DeletedLen())
+	assert.Equal(t, 1, store.State().Len())
+	assert.Len(t, events, 0)
+}
+
+func TestStoreWatch(t *testing.T) {
+	e := setUpTestEnvironment(t)
+	defer e.tearDown()
+
+	events, cancel := e.storeOne.Watch([]byte("a/"))
+
+	require.NoError(t, e.storeOne.Set([]byte("a/1"), testValue))
+	require.NoError(t, e.storeOne.Set([]byte("b/1"), testValue))
+	require.NoError(t, e.storeOne.Delete([]byte("a/1")))
+
+	assert.Equal(t, deks.Event{Type: deks.EventSet, Key: []byte("a/1"), Value: testValue}, <-events)
+	assert.Equal(t, deks.Event{Type: deks.EventDelete, Key: []byte("a/1"), Revision: 1}, <-events)
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+}
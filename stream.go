@@ -4,31 +4,48 @@ import (
 	"context"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/simia-tech/errx"
 )
 
+// streamMessageQueueSize defines the number of published messages, that are queued for a peer.
+const streamMessageQueueSize = 1024
+
 type stream struct {
 	ctx                   context.Context
 	cancel                context.CancelFunc
 	peerURL               string
 	peerPingInterval      time.Duration
 	peerReconnectInterval time.Duration
-	updates               chan streamUpdate
-	updatesMutex          sync.Mutex
+	queue                 *updateQueue
+	messages              chan message
+	batchSize             int
+	batchLinger           time.Duration
+	dropCount             int64
+	reconcileRequired     int32
+	store                 *Store
+	dialFn                func(string) (*Conn, error)
+	reconcilateFn         func(string) (int, int, error)
+	reconnecting          bool
+	legacy                int32
+	acks                  map[string]uint64
+	tombstoneGeneration   uint64
+	acksMutex             sync.RWMutex
 	metric                Metric
 }
 
-type streamUpdate struct {
-	keyHash   keyHash
-	container *container
-}
-
 func newStream(
 	peerURL string,
 	peerPingInterval time.Duration,
 	peerReconnectInterval time.Duration,
+	queue *updateQueue,
+	batchSize int,
+	batchLinger time.Duration,
+	store *Store,
+	dialFn func(string) (*Conn, error),
+	reconcilateFn func(string) (int, int, error),
 	m Metric,
 ) *stream {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -38,6 +55,14 @@ func newStream(
 		peerURL:               peerURL,
 		peerPingInterval:      peerPingInterval,
 		peerReconnectInterval: peerReconnectInterval,
+		queue:                 queue,
+		messages:              make(chan message, streamMessageQueueSize),
+		batchSize:             batchSize,
+		batchLinger:           batchLinger,
+		store:                 store,
+		dialFn:                dialFn,
+		reconcilateFn:         reconcilateFn,
+		acks:                  make(map[string]uint64),
 		metric:                m,
 	}
 	go s.loop()
@@ -61,27 +86,44 @@ func (s *stream) loop() {
 }
 
 func (s *stream) connect() error {
-	conn, err := Dial(s.peerURL)
+	conn, err := s.dialFn(s.peerURL)
 	if err != nil {
 		return errx.Annotatef(err, "dial")
 	}
 	defer conn.Close()
 
+	// Updates that occurred while the peer was disconnected, are repaired by a reconciliation.
+	if s.reconnecting {
+		atomic.StoreInt32(&s.reconcileRequired, 1)
+	}
+	s.reconnecting = true
+	s.reconcileIfRequired()
+
+	// Peers of protocol version 1 can't report their revisions, so the tombstones are kept for the
+	// grace period instead of being acknowledged.
+	if conn.version < 2 {
+		atomic.StoreInt32(&s.legacy, 1)
+	} else {
+		atomic.StoreInt32(&s.legacy, 0)
+	}
+
+	if err := s.syncTombstones(conn); err != nil {
+		return errx.Annotatef(err, "sync tombstones")
+	}
+
 	ticker := time.NewTicker(s.peerPingInterval)
+	defer ticker.Stop()
 
-	updates := make(chan streamUpdate)
-	defer func() {
-		s.updatesMutex.Lock()
-		s.updates = nil
-		close(updates)
-		s.updatesMutex.Unlock()
+	// Updates that have been queued while the peer was disconnected, are sent first.
+	s.queue.signal(s.queue.ready)
 
-		ticker.Stop()
+	b := &streamBatch{}
+	defer func() {
+		if len(b.updates) > 0 {
+			atomic.StoreInt32(&s.reconcileRequired, 1)
+		}
 	}()
-	s.updatesMutex.Lock()
-	s.updates = updates
-	s.updatesMutex.Unlock()
-
+	var lingerC <-chan time.Time
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -90,26 +132,219 @@ func (s *stream) connect() error {
 			if err := conn.Ping(); err != nil {
 				return errx.Annotatef(err, "ping")
 			}
-		case u := <-updates:
-			bytes, err := u.container.MarshalBinary()
+			s.reconcileIfRequired()
+			if s.store.tombstoneGeneration() != s.tombstoneGeneration {
+				if err := s.syncTombstones(conn); err != nil {
+					return errx.Annotatef(err, "sync tombstones")
+				}
+			}
+		case <-s.queue.ready:
+			if err := s.collect(conn, b); err != nil {
+				return errx.Annotatef(err, "collect")
+			}
+			if len(b.updates) == 0 {
+				lingerC = nil
+				continue
+			}
+			if s.batchLinger <= 0 {
+				if err := s.flush(conn, b); err != nil {
+					return errx.Annotatef(err, "flush")
+				}
+				continue
+			}
+			if lingerC == nil {
+				lingerC = time.After(s.batchLinger)
+			}
+		case <-lingerC:
+			lingerC = nil
+			if err := s.flush(conn, b); err != nil {
+				return errx.Annotatef(err, "flush")
+			}
+		case m := <-s.messages:
+			if conn.version < 2 {
+				continue // peers of protocol version 1 don't support messages
+			}
+			if err := conn.publishMessage(m); err != nil {
+				return errx.Annotatef(err, "publish message")
+			}
+		}
+	}
+}
+
+// streamBatch holds the updates, that are sent to the peer with the next frame.
+type streamBatch struct {
+	updates    []containerUpdate
+	containers []*container
+	size       int
+}
+
+// collect moves all queued updates into the provided batch. Each time the batch reaches the batch
+// size, it's sent to the peer.
+func (s *stream) collect(conn *Conn, b *streamBatch) error {
+	for {
+		changes, depth, ok := s.queue.pop()
+		if !ok {
+			return nil
+		}
+		s.metric.PeerQueueChanged(s.peerURL, depth)
+
+		for _, ch := range changes {
+			bytes, err := ch.container.marshalBinaryVersion(containerVersion(conn.version))
 			if err != nil {
 				return errx.Annotatef(err, "marshal binary")
 			}
-			if err := conn.setContainer(u.keyHash, bytes); err != nil {
-				return errx.Annotatef(err, "set container")
+			b.updates = append(b.updates, containerUpdate{keyHash: ch.keyHash, bytes: bytes, hops: ch.container.hops})
+			b.containers = append(b.containers, ch.container)
+			b.size += len(bytes)
+		}
+		if b.size >= s.batchSize {
+			if err := s.flush(conn, b); err != nil {
+				return err
 			}
 		}
 	}
 }
 
-func (s *stream) update(kh keyHash, container *container) {
-	s.updatesMutex.Lock()
-	if s.updates == nil {
-		s.updatesMutex.Unlock()
+// flush sends all updates of the provided batch to the peer in a single frame.
+func (s *stream) flush(conn *Conn, b *streamBatch) error {
+	if len(b.updates) == 0 {
+		return nil
+	}
+	if err := conn.setContainerBatch(b.updates); err != nil {
+		return errx.Annotatef(err, "set container batch")
+	}
+	for _, c := range b.containers {
+		if c.isDeleted() {
+			s.acknowledge(c.key, c.revision)
+		}
+	}
+	b.updates = b.updates[:0]
+	b.containers = b.containers[:0]
+	b.size = 0
+	return nil
+}
+
+// update queues the provided changes as a unit for the peer. If the queue is full, the update is
+// dropped and the peer is marked for a reconciliation.
+func (s *stream) update(changes []change) {
+	depth, ok := s.queue.pushChanges(changes)
+	s.metric.PeerQueueChanged(s.peerURL, depth)
+	if !ok {
+		s.metric.PeerUpdatesDropped(s.peerURL, int(atomic.AddInt64(&s.dropCount, 1)))
+		atomic.StoreInt32(&s.reconcileRequired, 1)
+	}
+}
+
+// publish queues the provided message for the peer. Messages are ephemeral, so if the queue is
+// full, the message is dropped.
+func (s *stream) publish(m message) {
+	select {
+	case s.messages <- m:
+	default:
+	}
+}
+
+// reconcileIfRequired starts a reconciliation with the peer, if updates have been lost.
+func (s *stream) reconcileIfRequired() {
+	if s.reconcilateFn == nil || !atomic.CompareAndSwapInt32(&s.reconcileRequired, 1, 0) {
 		return
 	}
-	s.updates <- streamUpdate{kh, container}
-	s.updatesMutex.Unlock()
+	go func() {
+		if _, _, err := s.reconcilateFn(s.peerURL); err != nil {
+			log.Printf("stream [%s]: reconcilate: %v", s.peerURL, err)
+			atomic.StoreInt32(&s.reconcileRequired, 1)
+		}
+	}()
+}
+
+// syncTombstones makes sure, that the peer knows about all deleted values, that haven't been
+// acknowledged yet. Deleted values the peer already holds, has never seen or has already
+// superseded are acknowledged without transfer. Besides on connect, it runs whenever new
+// tombstones have been applied, so tombstones received from other peers get acknowledged as well.
+func (s *stream) syncTombstones(conn *Conn) error {
+	generation := s.store.tombstoneGeneration()
+	defer func() { s.tombstoneGeneration = generation }()
+	tombstones := s.store.tombstones()
+	s.pruneAcks(tombstones)
+	if conn.version < 2 {
+		return nil
+	}
+
+	pending := []tombstone{}
+	keys := [][]byte{}
+	for _, t := range tombstones {
+		if !s.acknowledged(t.key, t.revision) {
+			pending = append(pending, t)
+			keys = append(keys, t.key)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	revisions, err := conn.getRevisions(keys)
+	if err != nil {
+		return errx.Annotatef(err, "get revisions")
+	}
+
+	for index, t := range pending {
+		if revisions[index] < 0 || uint64(revisions[index]) >= t.revision {
+			s.acknowledge(t.key, t.revision)
+			continue
+		}
+		bytes, err := s.store.getContainer(t.key, containerVersion(conn.version))
+		if err != nil {
+			return errx.Annotatef(err, "get container [%s]", t.key)
+		}
+		if bytes == nil {
+			continue
+		}
+		if _, err := conn.setContainer(s.store.keyHashFn(t.key), bytes); err != nil {
+			return errx.Annotatef(err, "set container [%s]", t.key)
+		}
+		s.acknowledge(t.key, t.revision)
+	}
+	return nil
+}
+
+func (s *stream) acknowledge(key []byte, revision uint64) {
+	s.acksMutex.Lock()
+	if ack, ok := s.acks[string(key)]; !ok || revision > ack {
+		s.acks[string(key)] = revision
+	}
+	s.acksMutex.Unlock()
+}
+
+func (s *stream) acknowledged(key []byte, revision uint64) bool {
+	if atomic.LoadInt32(&s.legacy) == 1 {
+		return true
+	}
+	s.acksMutex.RLock()
+	ack, ok := s.acks[string(key)]
+	s.acksMutex.RUnlock()
+	return ok && ack >= revision
+}
+
+// pruneAcks drops the acknowledgements of all keys, that are no longer deleted, so the number of
+// acknowledgements is bound to the number of tombstones.
+func (s *stream) pruneAcks(tombstones []tombstone) {
+	deleted := make(map[string]struct{}, len(tombstones))
+	for _, t := range tombstones {
+		deleted[string(t.key)] = struct{}{}
+	}
+	s.acksMutex.Lock()
+	for key := range s.acks {
+		if _, ok := deleted[key]; !ok {
+			delete(s.acks, key)
+		}
+	}
+	s.acksMutex.Unlock()
+}
+
+func (s *stream) forget(key []byte) {
+	s.acksMutex.Lock()
+	delete(s.acks, string(key))
+	s.acksMutex.Unlock()
 }
 
 func (s *stream) close() {
@@ -0,0 +1,78 @@
+package deks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/simia-tech/errx"
+)
+
+const schemeTLS = "tls"
+
+// NewTLSConfig returns a tls config, that uses the provided certificate and key for the listener
+// as well as for connections to peers. If a ca file is provided, it's certificates are used to
+// verify the peers. If verifyClients is set, clients have to present a certificate that has
+// been signed by the ca, which enables mutual tls between peers.
+func NewTLSConfig(certFile, keyFile, caFile string, verifyClients bool) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errx.Annotatef(err, "load key pair [%s %s]", certFile, keyFile)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errx.Annotatef(err, "read [%s]", caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errx.BadRequestf("no certificates found in [%s]", caFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+	}
+	if verifyClients {
+		if config.ClientCAs == nil {
+			return nil, errx.BadRequestf("verification of clients requires a ca")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func listen(network, address string, secure bool, config *tls.Config) (net.Listener, error) {
+	if !secure {
+		return net.Listen(network, address)
+	}
+	if config == nil || len(config.Certificates) == 0 {
+		return nil, errx.BadRequestf("tls listener requires a certificate")
+	}
+	return tls.Listen(network, address, config)
+}
+
+// dial establishes a connection to the provided address. If the timeout is zero, no timeout is
+// applied. Secure connections verify the server's certificate against the host of the address.
+func dial(network, address string, secure bool, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !secure {
+		return dialer.Dial(network, address)
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, errx.Annotatef(err, "split host port [%s]", address)
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	return tls.DialWithDialer(dialer, network, address, config)
+}
@@ -0,0 +1,139 @@
+package deks_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simia-tech/deks"
+)
+
+func TestServerTLS(t *testing.T) {
+	caFile, certFile, keyFile := writeTestCertificates(t)
+	m := deks.NewMetricMock()
+
+	serverConfig, err := deks.NewTLSConfig(certFile, keyFile, caFile, false)
+	require.NoError(t, err)
+	server, err := deks.NewServerWithTLS(deks.NewStore(m), "tls://localhost:0", serverConfig, m)
+	require.NoError(t, err)
+	defer server.Close()
+
+	clientConfig, err := deks.NewTLSConfig("", "", caFile, false)
+	require.NoError(t, err)
+	conn, err := deks.DialTLS(server.ListenURL(), clientConfig)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.Set(testKey, testValue))
+	value, err := conn.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+}
+
+func TestServerMutualTLSRejectsClientWithoutCertificate(t *testing.T) {
+	caFile, certFile, keyFile := writeTestCertificates(t)
+	m := deks.NewMetricMock()
+
+	serverConfig, err := deks.NewTLSConfig(certFile, keyFile, caFile, true)
+	require.NoError(t, err)
+	server, err := deks.NewServerWithTLS(deks.NewStore(m), "tls://localhost:0", serverConfig, m)
+	require.NoError(t, err)
+	defer server.Close()
+
+	clientConfig, err := deks.NewTLSConfig("", "", caFile, false)
+	require.NoError(t, err)
+	conn, err := deks.DialTLS(server.ListenURL(), clientConfig)
+	if err == nil {
+		defer conn.Close()
+		err = conn.Set(testKey, testValue)
+	}
+	assert.Error(t, err)
+}
+
+func TestServerMutualTLSStreamUpdates(t *testing.T) {
+	caFile, certFile, keyFile := writeTestCertificates(t)
+	m := deks.NewMetricMock()
+
+	config, err := deks.NewTLSConfig(certFile, keyFile, caFile, true)
+	require.NoError(t, err)
+
+	storeOne := deks.NewStore(m)
+	serverOne, err := deks.NewServerWithTLS(storeOne, "tls://localhost:0", config, m)
+	require.NoError(t, err)
+	defer serverOne.Close()
+
+	storeTwo := deks.NewStore(m)
+	serverTwo, err := deks.NewServerWithTLS(storeTwo, "tls://localhost:0", config, m)
+	require.NoError(t, err)
+	defer serverTwo.Close()
+
+	require.NoError(t, serverOne.AddPeer(serverTwo.ListenURL(), time.Minute, time.Minute))
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, storeOne.Set(testKey, testValue))
+	time.Sleep(100 * time.Millisecond)
+
+	value, err := storeTwo.Get(testKey)
+	require.NoError(t, err)
+	assert.Equal(t, testValue, value)
+}
+
+// writeTestCertificates writes a ca and a certificate for localhost, that is signed by the ca,
+// into a temporary directory. The certificate can be used by servers and clients.
+func writeTestCertificates(tb testing.TB) (string, string, string) {
+	dir := tb.TempDir()
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := time.Now().Add(time.Hour)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(tb, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(tb, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(tb, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	require.NoError(tb, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(tb, err)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(tb, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644))
+	require.NoError(tb, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(tb, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	return caFile, certFile, keyFile
+}
@@ -0,0 +1,301 @@
+package deks
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/simia-tech/errx"
+	redisserver "github.com/tidwall/redcon"
+)
+
+// Tx defines a transaction on a store. The writes of a transaction are collected and applied at
+// once, when the transaction ends.
+type Tx struct {
+	store  *Store
+	writes []txWrite
+	index  map[string]int
+}
+
+type txWrite struct {
+	key       []byte
+	value     []byte
+	expiresAt time.Time
+	deleted   bool
+}
+
+// Update runs the provided function within a transaction. If the function returns nil, all writes
+// of the transaction are applied atomically and replicated to the peers as a unit. Otherwise, the
+// writes are discarded and the error is returned. The store is locked while the function runs,
+// so it must only be accessed via the transaction.
+func (s *Store) Update(fn func(*Tx) error) error {
+	s.lock()
+	defer s.unlock()
+
+	tx := &Tx{store: s, index: make(map[string]int)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	changes := []change{}
+	for _, w := range tx.writes {
+		kh := s.keyHashFn(w.key)
+		if w.deleted {
+			_, c := s.containers[kh].find(w.key)
+			if c == nil || c.isDeleted() {
+				continue
+			}
+			changes = append(changes, change{keyHash: kh, container: s.nextTombstone(c)})
+			continue
+		}
+		changes = append(changes, change{keyHash: kh, container: s.nextContainer(kh, w.key, w.value, w.expiresAt)})
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := s.persistChanges(changes); err != nil {
+		return errx.Annotatef(err, "persist")
+	}
+	for _, ch := range changes {
+		s.applyContainer(ch.keyHash, ch.container)
+	}
+	s.notifyChanges(changes)
+	return nil
+}
+
+// Get returns the value at the provided key including the writes of the transaction. If no value
+// exists, nil is returned.
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	if w := tx.find(key); w != nil {
+		if w.deleted || (!w.expiresAt.IsZero() && !w.expiresAt.After(time.Now())) {
+			return nil, nil
+		}
+		return w.value, nil
+	}
+	c := tx.store.liveContainer(tx.store.keyHashFn(key), key)
+	if c == nil {
+		return nil, nil
+	}
+	return c.value, nil
+}
+
+// Set sets the provided value at the provided key.
+func (tx *Tx) Set(key, value []byte) error {
+	tx.write(txWrite{key: key, value: value})
+	return nil
+}
+
+// SetWithTTL sets the provided value at the provided key. After the provided ttl, the value
+// expires.
+func (tx *Tx) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	tx.write(txWrite{key: key, value: value, expiresAt: time.Now().Add(ttl)})
+	return nil
+}
+
+// Delete removes the value at the provided key.
+func (tx *Tx) Delete(key []byte) error {
+	tx.write(txWrite{key: key, deleted: true})
+	return nil
+}
+
+// revision returns the revision of the provided key as it was before the transaction. Deleted
+// values are considered as well. If the key doesn't exist, false is returned.
+func (tx *Tx) revision(key []byte) (uint64, bool) {
+	_, c := tx.store.containers[tx.store.keyHashFn(key)].find(key)
+	if c == nil {
+		return 0, false
+	}
+	return c.revision, true
+}
+
+func (tx *Tx) find(key []byte) *txWrite {
+	index, ok := tx.index[string(key)]
+	if !ok {
+		return nil
+	}
+	return &tx.writes[index]
+}
+
+func (tx *Tx) write(w txWrite) {
+	if existing := tx.find(w.key); existing != nil {
+		*existing = w
+		return
+	}
+	tx.index[string(w.key)] = len(tx.writes)
+	tx.writes = append(tx.writes, w)
+}
+
+// queuedCommand defines a command, that has been queued within a MULTI block.
+type queuedCommand struct {
+	command   string
+	arguments [][]byte
+}
+
+// watchedKey defines the state of a key at the time it has been watched.
+type watchedKey struct {
+	revision uint64
+	exists   bool
+}
+
+// multiCommands contains the commands, that are executed immediately within a MULTI block.
+var multiCommands = map[string]bool{
+	cmdMulti:   true,
+	cmdExec:    true,
+	cmdDiscard: true,
+	cmdWatch:   true,
+	cmdUnwatch: true,
+	cmdQuit:    true,
+}
+
+// txCommands contains the commands, that can be queued within a MULTI block.
+var txCommands = map[string]bool{
+	cmdSet:    true,
+	cmdGet:    true,
+	cmdDelete: true,
+	cmdExists: true,
+	cmdMGet:   true,
+	cmdMSet:   true,
+}
+
+var errWatchedKeyChanged = errx.Errorf("watched key changed")
+
+// queue adds the provided command to the session's transaction.
+func (ss *session) queue(command string, arguments [][]byte) error {
+	if !txCommands[command] {
+		return replyError(fmt.Sprintf("ERR command '%s' can't be used in a transaction", command))
+	}
+	switch command {
+	case cmdSet:
+		if _, _, err := parseSetOptions(arguments[2:]); err != nil {
+			return err
+		}
+	case cmdMSet:
+		if len(arguments)%2 != 0 {
+			return errWrongArity(command)
+		}
+	}
+	ss.queued = append(ss.queued, queuedCommand{command: command, arguments: arguments})
+	return nil
+}
+
+// watch records the current state of the provided keys.
+func (ss *session) watch(store *Store, keys [][]byte) {
+	if ss.watched == nil {
+		ss.watched = make(map[string]watchedKey)
+	}
+	for _, key := range keys {
+		revision, ok := store.getRevision(key)
+		ss.watched[string(key)] = watchedKey{revision: revision, exists: ok}
+	}
+}
+
+// resetMulti ends the session's transaction and forgets all watched keys.
+func (ss *session) resetMulti() {
+	ss.multi = false
+	ss.multiFailed = false
+	ss.queued = nil
+	ss.watched = nil
+}
+
+// exec runs the provided commands within a single store transaction and writes their replies. If
+// one of the watched keys has been changed, no command is run and a null reply is written.
+func (s *Server) exec(w *redisserver.Writer, queued []queuedCommand, watched map[string]watchedKey) error {
+	replies := redisserver.NewWriter(nil)
+	err := s.store.Update(func(tx *Tx) error {
+		for key, wk := range watched {
+			if revision, ok := tx.revision([]byte(key)); ok != wk.exists || revision != wk.revision {
+				return errWatchedKeyChanged
+			}
+		}
+		for _, qc := range queued {
+			if err := executeInTx(tx, replies, qc.command, qc.arguments); err != nil {
+				replies.WriteError(errorReply(err))
+			}
+		}
+		return nil
+	})
+	if err == errWatchedKeyChanged {
+		w.WriteNull()
+		return nil
+	}
+	if err != nil {
+		return errx.Annotatef(err, "update")
+	}
+	w.WriteArray(len(queued))
+	w.WriteRaw(replies.Buffer())
+	return nil
+}
+
+// executeInTx runs the provided command within the provided transaction.
+func executeInTx(tx *Tx, w *redisserver.Writer, command string, arguments [][]byte) error {
+	switch command {
+	case cmdSet:
+		ttl, condition, err := parseSetOptions(arguments[2:])
+		if err != nil {
+			return err
+		}
+		if condition != nil {
+			value, err := tx.Get(arguments[0])
+			if err != nil {
+				return errx.Annotatef(err, "get [%s]", arguments[0])
+			}
+			var current *container
+			if value != nil {
+				current = &container{key: arguments[0], value: value}
+			}
+			if !condition(current) {
+				w.WriteNull()
+				return nil
+			}
+		}
+		if ttl > 0 {
+			err = tx.SetWithTTL(arguments[0], arguments[1], ttl)
+		} else {
+			err = tx.Set(arguments[0], arguments[1])
+		}
+		if err != nil {
+			return errx.Annotatef(err, "set [%s]", arguments[0])
+		}
+		w.WriteString("OK")
+	case cmdGet:
+		value, err := tx.Get(arguments[0])
+		if err != nil {
+			return errx.Annotatef(err, "get [%s]", arguments[0])
+		}
+		writeBulkOrNull(w, value)
+	case cmdDelete, cmdExists:
+		count := 0
+		for _, key := range arguments {
+			value, err := tx.Get(key)
+			if err != nil {
+				return errx.Annotatef(err, "get [%s]", key)
+			}
+			if value == nil {
+				continue
+			}
+			count++
+			if command == cmdDelete {
+				if err := tx.Delete(key); err != nil {
+					return errx.Annotatef(err, "delete [%s]", key)
+				}
+			}
+		}
+		w.WriteInt(count)
+	case cmdMGet:
+		w.WriteArray(len(arguments))
+		for _, key := range arguments {
+			value, err := tx.Get(key)
+			if err != nil {
+				return errx.Annotatef(err, "get [%s]", key)
+			}
+			writeBulkOrNull(w, value)
+		}
+	case cmdMSet:
+		for index := 0; index < len(arguments); index += 2 {
+			if err := tx.Set(arguments[index], arguments[index+1]); err != nil {
+				return errx.Annotatef(err, "set [%s]", arguments[index])
+			}
+		}
+		w.WriteString("OK")
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package deks
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	redisserver "github.com/tidwall/redcon"
+)
+
+// watchBufferSize defines the number of events, that are buffered for a watcher.
+const watchBufferSize = 256
+
+// EventType defines the type of a change.
+type EventType int
+
+// Event types.
+const (
+	EventSet EventType = iota
+	EventDelete
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// parseEventType returns the event type with the provided name.
+func parseEventType(name string) (EventType, bool) {
+	switch name {
+	case "set":
+		return EventSet, true
+	case "delete":
+		return EventDelete, true
+	}
+	return 0, false
+}
+
+// Event defines a change of a value in the store.
+type Event struct {
+	Type     EventType
+	Key      []byte
+	Value    []byte
+	Revision uint64
+
+	// Remote is true, if the change has been received from a peer.
+	Remote bool
+}
+
+// watcher defines a subscription to the changes of all keys with a prefix.
+type watcher struct {
+	prefix []byte
+	events chan Event
+}
+
+// watchers holds the watchers of a store.
+type watchers struct {
+	items map[*watcher]struct{}
+	mutex sync.Mutex
+}
+
+// Watch returns a channel, that receives an event for every change of a key with the provided
+// prefix. Local changes as well as changes received from peers are reported. The returned
+// function cancels the watch and closes the channel. The events are sent without blocking the
+// store, so if the receiver falls behind and the channel's buffer is full, the watch is cancelled
+// as well.
+func (s *Store) Watch(prefix []byte) (<-chan Event, func()) {
+	w := &watcher{
+		prefix: append([]byte{}, prefix...),
+		events: make(chan Event, watchBufferSize),
+	}
+	s.watchers.mutex.Lock()
+	if s.watchers.items == nil {
+		s.watchers.items = make(map[*watcher]struct{})
+	}
+	s.watchers.items[w] = struct{}{}
+	s.watchers.mutex.Unlock()
+
+	return w.events, func() {
+		s.watchers.mutex.Lock()
+		s.watchers.remove(w)
+		s.watchers.mutex.Unlock()
+	}
+}
+
+// dispatch sends an event for each of the provided changes to the matching watchers.
+func (ws *watchers) dispatch(changes []change, remote bool) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	if len(ws.items) == 0 {
+		return
+	}
+	for _, ch := range changes {
+		event := newEvent(ch.container, remote)
+		for w := range ws.items {
+			if !bytes.HasPrefix(event.Key, w.prefix) {
+				continue
+			}
+			select {
+			case w.events <- event:
+			default:
+				ws.remove(w)
+			}
+		}
+	}
+}
+
+// remove deletes the provided watcher and closes it's channel. The caller has to hold the mutex.
+func (ws *watchers) remove(w *watcher) {
+	if _, ok := ws.items[w]; !ok {
+		return
+	}
+	delete(ws.items, w)
+	close(w.events)
+}
+
+func newEvent(c *container, remote bool) Event {
+	event := Event{
+		Type:     EventSet,
+		Key:      c.key,
+		Value:    c.value,
+		Revision: c.revision,
+		Remote:   remote,
+	}
+	if c.isDeleted() {
+		event.Type = EventDelete
+	}
+	return event
+}
+
+// pushCommands contains the commands, that can be run on a connection, that observes prefixes or
+// subscribes to channels.
+var pushCommands = map[string]bool{
+	cmdObserve:      true,
+	cmdUnobserve:    true,
+	cmdSubscribe:    true,
+	cmdUnsubscribe:  true,
+	cmdPSubscribe:   true,
+	cmdPUnsubscribe: true,
+	cmdPing:         true,
+	cmdQuit:         true,
+}
+
+// observation defines the observation of a prefix by a session.
+type observation struct {
+	cancel func()
+}
+
+// observe starts streaming the changes of all keys with the provided prefix to the session. Only
+// changes of keys, the session is allowed to read, are streamed. If the session falls behind, an
+// error is written and the connection is closed. The caller has to hold the write mutex.
+func (s *Server) observe(conn net.Conn, w *redisserver.Writer, ss *session, prefix []byte) {
+	if ss.observed == nil {
+		ss.observed = make(map[string]*observation)
+	}
+	if _, ok := ss.observed[string(prefix)]; !ok {
+		events, cancel := s.store.Watch(prefix)
+		o := &observation{cancel: cancel}
+		ss.observed[string(prefix)] = o
+		go s.streamEvents(conn, w, ss, o, prefix, events)
+	}
+	writeSubscriptionReply(w, cmdObserve, prefix, ss.subscriptionCount())
+}
+
+func (s *Server) streamEvents(conn net.Conn, w *redisserver.Writer, ss *session, o *observation, prefix []byte, events <-chan Event) {
+	for event := range events {
+		if !ss.canRead(event.Key) {
+			continue
+		}
+		ss.writeMutex.Lock()
+		writeEvent(w, prefix, event)
+		err := w.Flush()
+		ss.writeMutex.Unlock()
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	ss.writeMutex.Lock()
+	defer ss.writeMutex.Unlock()
+	if ss.observed[string(prefix)] != o {
+		return
+	}
+	w.WriteError(fmt.Sprintf("ERR observation of prefix [%s] cancelled, because the client fell behind", prefix))
+	w.Flush()
+	conn.Close()
+}
+
+// unobserve stops streaming the changes of the provided prefixes to the session. If no prefixes
+// are provided, all observations are stopped.
+func (ss *session) unobserve(w *redisserver.Writer, prefixes [][]byte) {
+	if len(prefixes) == 0 {
+		for prefix := range ss.observed {
+			prefixes = append(prefixes, []byte(prefix))
+		}
+		sort.Slice(prefixes, func(i, j int) bool { return bytes.Compare(prefixes[i], prefixes[j]) < 0 })
+	}
+	if len(prefixes) == 0 {
+		writeSubscriptionReply(w, cmdUnobserve, nil, ss.subscriptionCount())
+		return
+	}
+	for _, prefix := range prefixes {
+		if o, ok := ss.observed[string(prefix)]; ok {
+			delete(ss.observed, string(prefix))
+			o.cancel()
+		}
+		writeSubscriptionReply(w, cmdUnobserve, prefix, ss.subscriptionCount())
+	}
+}
+
+// unobserveAll stops all observations of the session. The caller has to hold the write mutex.
+func (ss *session) unobserveAll() {
+	for prefix, o := range ss.observed {
+		delete(ss.observed, prefix)
+		o.cancel()
+	}
+}
+
+func writeEvent(w *redisserver.Writer, prefix []byte, event Event) {
+	w.WriteArray(6)
+	w.WriteBulkString("event")
+	w.WriteBulk(prefix)
+	w.WriteBulkString(event.Type.String())
+	w.WriteBulk(event.Key)
+	writeBulkOrNull(w, event.Value)
+	w.WriteInt64(int64(event.Revision))
+}